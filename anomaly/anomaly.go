@@ -0,0 +1,285 @@
+// Package anomaly detects sudden changes in the message rates of tags and
+// hosts.
+//
+// Messages are counted per minute. For every tag and host a baseline of
+// the rate is kept for each hour of the day, as an exponentially weighted
+// moving average and variance, so a nightly batch job doesn't count as a
+// flood every night. A rate which differs more than Sigma standard
+// deviations from its baseline is an anomaly, a spike if it is higher and
+// a drop if it is lower. An anomaly is reported once, when it starts, and
+// again when the rate is back to normal.
+package anomaly
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// Directions of anomalies.
+const (
+	Spike  = "spike"
+	Drop   = "drop"
+	Normal = "normal"
+)
+
+// Options contain the configuration of a Detector.
+type Options struct {
+	// Bucket is the period messages are counted over, default 1 minute.
+	Bucket time.Duration
+	// Alpha is the weight of a new rate in the baseline, default 0.05.
+	Alpha float64
+	// Sigma is the number of standard deviations a rate must differ from
+	// its baseline to be an anomaly, default 4.
+	Sigma float64
+	// MinSamples is the number of rates a baseline needs before it is used,
+	// default 30.
+	MinSamples int
+	// MinRate is the minimum baseline rate per bucket for drops, so streams
+	// of a few messages an hour don't raise drops, default 5.
+	MinRate float64
+	// MaxKeys limits the number of tags and hosts tracked, default 10000.
+	MaxKeys int
+	// StateFile, if set, is where the baselines are saved every hour and
+	// read from at start, so they survive restarts.
+	StateFile string
+	// OnAnomaly is called when an anomaly starts or ends.
+	OnAnomaly func(ev Event)
+}
+
+// Event reports the start or end of an anomaly.
+type Event struct {
+	// Kind is "tag" or "host".
+	Kind string
+	Name string
+	// Direction is Spike, Drop, or Normal when an anomaly ended.
+	Direction string
+	Time      time.Time
+	// Rate is the number of messages in the bucket, Mean and StdDev
+	// describe the baseline for the hour of the day.
+	Rate   float64
+	Mean   float64
+	StdDev float64
+}
+
+// baseline is the EWMA of the rate for one hour of the day.
+type baseline struct {
+	Mean, Var float64
+	N         int
+}
+
+type series struct {
+	Kind, Name string
+	Hours      [24]baseline
+	count      int
+	state      string
+}
+
+// Detector counts messages and detects anomalies. It is safe for
+// concurrent use.
+type Detector struct {
+	opts     Options
+	series   map[string]*series
+	lastSave int
+	mu       sync.Mutex
+}
+
+// New creates a Detector, reads its state file if configured and starts
+// checking rates every bucket.
+func New(opts Options) (*Detector, error) {
+	d := newDetector(opts)
+	if opts.StateFile != "" {
+		if err := d.load(); err != nil {
+			return nil, err
+		}
+	}
+	go func() {
+		for now := range time.Tick(d.opts.Bucket) {
+			d.Flush(now)
+		}
+	}()
+	return d, nil
+}
+
+func newDetector(opts Options) *Detector {
+	if opts.Bucket == 0 {
+		opts.Bucket = time.Minute
+	}
+	if opts.Alpha == 0 {
+		opts.Alpha = 0.05
+	}
+	if opts.Sigma == 0 {
+		opts.Sigma = 4
+	}
+	if opts.MinSamples == 0 {
+		opts.MinSamples = 30
+	}
+	if opts.MinRate == 0 {
+		opts.MinRate = 5
+	}
+	if opts.MaxKeys == 0 {
+		opts.MaxKeys = 10000
+	}
+	return &Detector{opts: opts, series: make(map[string]*series), lastSave: -1}
+}
+
+// Add counts a message for its tag and host.
+func (d *Detector) Add(m *syslogd.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.count("tag", m.Tag)
+	d.count("host", m.Hostname)
+}
+
+func (d *Detector) count(kind, name string) {
+	k := kind + ":" + name
+	s, x := d.series[k]
+	if !x {
+		if len(d.series) >= d.opts.MaxKeys {
+			return
+		}
+		s = &series{Kind: kind, Name: name, state: Normal}
+		d.series[k] = s
+	}
+	s.count++
+}
+
+// Flush ends the current bucket at now, checks the rates of all tags and
+// hosts against their baselines and updates the baselines. It is called
+// every bucket.
+func (d *Detector) Flush(now time.Time) {
+	var events []Event
+
+	d.mu.Lock()
+	hour := now.Add(-d.opts.Bucket / 2).Hour()
+	for _, s := range d.series {
+		rate := float64(s.count)
+		s.count = 0
+		b := &s.Hours[hour]
+		learn := rate
+
+		if b.N >= d.opts.MinSamples {
+			std := math.Sqrt(b.Var)
+			// Rates are counts, their deviation is at least about the
+			// square root of the mean.
+			std = math.Max(std, math.Sqrt(b.Mean)+1)
+			// Anomalies only move the baseline as far as the edge of the
+			// normal range, so a flood doesn't hide the drop after it but a
+			// lasting change is still learned.
+			lo, hi := b.Mean-d.opts.Sigma*std, b.Mean+d.opts.Sigma*std
+			learn = math.Max(lo, math.Min(hi, rate))
+			dir := Normal
+			switch {
+			case rate > hi:
+				dir = Spike
+			case rate < lo && b.Mean >= d.opts.MinRate:
+				dir = Drop
+			}
+			if dir != s.state {
+				s.state = dir
+				events = append(events, Event{
+					Kind:      s.Kind,
+					Name:      s.Name,
+					Direction: dir,
+					Time:      now,
+					Rate:      rate,
+					Mean:      b.Mean,
+					StdDev:    std,
+				})
+			}
+		}
+
+		// Exponentially weighted mean and variance.
+		if b.N == 0 {
+			b.Mean = learn
+		} else {
+			diff := learn - b.Mean
+			incr := d.opts.Alpha * diff
+			b.Mean += incr
+			b.Var = (1 - d.opts.Alpha) * (b.Var + diff*incr)
+		}
+		b.N++
+	}
+
+	save := d.opts.StateFile != "" && hour != d.lastSave
+	d.lastSave = hour
+	d.mu.Unlock()
+
+	if save {
+		if err := d.save(); err != nil {
+			fmt.Printf("Saving anomaly baselines to %s failed: %v\n", d.opts.StateFile, err)
+		}
+	}
+	if d.opts.OnAnomaly != nil {
+		for _, ev := range events {
+			d.opts.OnAnomaly(ev)
+		}
+	}
+}
+
+// Active returns the ongoing anomalies, ordered by kind and name.
+func (d *Detector) Active() []Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var events []Event
+	for _, s := range d.series {
+		if s.state != Normal {
+			events = append(events, Event{Kind: s.Kind, Name: s.Name, Direction: s.state})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Kind != events[j].Kind {
+			return events[i].Kind < events[j].Kind
+		}
+		return events[i].Name < events[j].Name
+	})
+	return events
+}
+
+func (d *Detector) load() error {
+	b, err := ioutil.ReadFile(d.opts.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state []*series
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	for _, s := range state {
+		s.state = Normal
+		d.series[s.Kind+":"+s.Name] = s
+	}
+	return nil
+}
+
+func (d *Detector) save() error {
+	d.mu.Lock()
+	b, err := json.Marshal(d.seriesList())
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := d.opts.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.opts.StateFile)
+}
+
+func (d *Detector) seriesList() []*series {
+	l := make([]*series, 0, len(d.series))
+	for _, s := range d.series {
+		l = append(l, s)
+	}
+	return l
+}
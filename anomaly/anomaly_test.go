@@ -0,0 +1,51 @@
+package anomaly
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+func TestDetector(t *testing.T) {
+	var events []Event
+	d := newDetector(Options{OnAnomaly: func(ev Event) { events = append(events, ev) }})
+
+	now := time.Date(2016, 3, 12, 10, 0, 0, 0, time.UTC)
+	minute := func(n int) {
+		for i := 0; i < n; i++ {
+			d.Add(&syslogd.Message{Tag: "sshd", Hostname: "web1"})
+		}
+		now = now.Add(time.Minute)
+		d.Flush(now)
+	}
+
+	// Learn a baseline of about 100 messages a minute.
+	for i := 0; i < 50; i++ {
+		minute(98 + i%5)
+	}
+	if len(events) != 0 {
+		t.Fatalf("Unexpected events while learning %+v", events)
+	}
+
+	minute(400)
+	if len(events) != 2 || events[0].Direction != Spike || events[1].Direction != Spike {
+		t.Fatalf("Expected a spike of the tag and the host, got %+v", events)
+	}
+	if len(d.Active()) != 2 {
+		t.Errorf("Expected 2 active anomalies, got %+v", d.Active())
+	}
+
+	// Reported once.
+	events = nil
+	minute(400)
+	if len(events) != 0 {
+		t.Fatalf("Expected an ongoing spike not to be reported again, got %+v", events)
+	}
+
+	minute(100)
+	minute(0)
+	if len(events) != 4 || events[3].Direction != Drop {
+		t.Fatalf("Expected the end of the spike and a drop, got %+v", events)
+	}
+}
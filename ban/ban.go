@@ -0,0 +1,448 @@
+// Package ban bans IP addresses after repeated failures, like fail2ban but
+// for the logs of all hosts at once.
+//
+// Rules with a "ban" action report a failure of the IP address in one of
+// their capture groups. An address with MaxRetry failures within FindTime
+// is banned for BanTime. Banned addresses are listed by List, written to a
+// file in ipset or nftables format and passed to a command, so firewalls
+// can pick them up. Bans are kept across restarts in a state file.
+package ban
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File formats.
+const (
+	// FormatPlain writes one address per line.
+	FormatPlain = "plain"
+	// FormatIPSet writes a script for "ipset restore".
+	FormatIPSet = "ipset"
+	// FormatNftables writes a script for "nft -f".
+	FormatNftables = "nftables"
+)
+
+// commandTimeout is the time a command may run.
+const commandTimeout = 30 * time.Second
+
+// Options contain the configuration of a Banner.
+type Options struct {
+	// MaxRetry is the number of failures which bans an address, default 5.
+	MaxRetry int
+	// FindTime is the window failures are counted in, default 10 minutes.
+	FindTime time.Duration
+	// BanTime is how long an address stays banned, default 1 hour.
+	BanTime time.Duration
+	// Ignore contains networks which are never banned.
+	Ignore []*net.IPNet
+
+	// File, if set, is rewritten with all banned addresses on every change,
+	// in Format, default FormatPlain.
+	File   string
+	Format string
+	// Set is the name of the ipset, or the family, table and name of the
+	// nftables set, default "gosyslogd" and "inet filter gosyslogd". IPv6
+	// addresses are written to a set with "6" appended to its name.
+	Set string
+
+	// Command, if set, is run with the arguments "ban" or "unban" and the
+	// address appended, e.g. "/usr/local/bin/firewall" runs
+	// "/usr/local/bin/firewall ban 192.0.2.1". Commands run one at a time,
+	// in the order of the bans and unbans.
+	Command []string
+
+	// StateFile, if set, keeps the bans across restarts. On start bans
+	// which are still active are banned again, the others are unbanned,
+	// so commands must accept addresses they already know about.
+	StateFile string
+
+	// OnBan and OnUnban, if set, are called when an address is banned or
+	// its ban ends.
+	OnBan   func(b Ban)
+	OnUnban func(b Ban)
+}
+
+// Ban is a banned address.
+type Ban struct {
+	IP string
+	// Rule and Host are of the failure which caused the ban.
+	Rule  string
+	Host  string
+	Count int
+	Start time.Time
+	Until time.Time
+}
+
+// Banner counts failures and keeps the banned addresses. It is safe for
+// concurrent use.
+type Banner struct {
+	opts     Options
+	failures map[string][]time.Time
+	bans     map[string]*Ban
+	mu       sync.Mutex
+	fileMu   sync.Mutex
+
+	// commands holds the commands to run in order, guarded by mu.
+	commands []command
+	wake     chan bool
+}
+
+// command is a run of Options.Command.
+type command struct {
+	action, ip string
+}
+
+// New creates a Banner, restores the bans of the state file and starts
+// expiring bans.
+func New(opts Options) (*Banner, error) {
+	b, err := newBanner(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.loadState(time.Now()); err != nil {
+		return nil, err
+	}
+	if err := b.writeFile(); err != nil {
+		return nil, err
+	}
+	if err := b.saveState(); err != nil {
+		return nil, err
+	}
+	go b.runner()
+	go func() {
+		for now := range time.Tick(10 * time.Second) {
+			b.Expire(now)
+		}
+	}()
+	return b, nil
+}
+
+func newBanner(opts Options) (*Banner, error) {
+	if opts.MaxRetry == 0 {
+		opts.MaxRetry = 5
+	}
+	if opts.FindTime == 0 {
+		opts.FindTime = 10 * time.Minute
+	}
+	if opts.BanTime == 0 {
+		opts.BanTime = time.Hour
+	}
+	switch opts.Format {
+	case "":
+		opts.Format = FormatPlain
+	case FormatPlain, FormatIPSet, FormatNftables:
+	default:
+		return nil, fmt.Errorf("unknown ban file format %q", opts.Format)
+	}
+	if opts.Set == "" {
+		opts.Set = "gosyslogd"
+		if opts.Format == FormatNftables {
+			opts.Set = "inet filter gosyslogd"
+		}
+	}
+	return &Banner{
+		opts:     opts,
+		failures: make(map[string][]time.Time),
+		bans:     make(map[string]*Ban),
+		wake:     make(chan bool, 1),
+	}, nil
+}
+
+// loadState restores the bans of the state file. Bans which ended before
+// now are unbanned.
+func (b *Banner) loadState(now time.Time) error {
+	if b.opts.StateFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(b.opts.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("Can't read ban state %s: %v", b.opts.StateFile, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range bans {
+		ban := &bans[i]
+		if now.Before(ban.Until) {
+			b.bans[ban.IP] = ban
+			b.queue("ban", ban.IP)
+		} else {
+			b.queue("unban", ban.IP)
+		}
+	}
+	return nil
+}
+
+// Fail counts a failure of address ip, reported by rule for a message of
+// host at time t. It returns the ban and true when the address got banned.
+// Invalid, ignored and already banned addresses are not counted.
+func (b *Banner) Fail(ip, rule, host string, t time.Time) (Ban, bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil || b.ignored(addr) {
+		return Ban{}, false
+	}
+	ip = addr.String()
+
+	b.mu.Lock()
+	if _, x := b.bans[ip]; x {
+		b.mu.Unlock()
+		return Ban{}, false
+	}
+	times := b.failures[ip]
+	for len(times) > 0 && t.Sub(times[0]) > b.opts.FindTime {
+		times = times[1:]
+	}
+	times = append(times, t)
+	if len(times) < b.opts.MaxRetry {
+		b.failures[ip] = times
+		b.mu.Unlock()
+		return Ban{}, false
+	}
+	delete(b.failures, ip)
+	ban := &Ban{IP: ip, Rule: rule, Host: host, Count: len(times), Start: t, Until: t.Add(b.opts.BanTime)}
+	b.bans[ip] = ban
+	b.queue("ban", ip)
+	b.mu.Unlock()
+
+	b.changed()
+	if b.opts.OnBan != nil {
+		b.opts.OnBan(*ban)
+	}
+	return *ban, true
+}
+
+func (b *Banner) ignored(ip net.IP) bool {
+	for _, n := range b.opts.Ignore {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unban ends the ban of ip. It returns false if ip is not banned.
+func (b *Banner) Unban(ip string) bool {
+	if addr := net.ParseIP(ip); addr != nil {
+		ip = addr.String()
+	}
+	b.mu.Lock()
+	ban, x := b.bans[ip]
+	if x {
+		delete(b.bans, ip)
+		b.queue("unban", ip)
+	}
+	b.mu.Unlock()
+	if !x {
+		return false
+	}
+	b.unbanned(*ban)
+	return true
+}
+
+// Expire ends the bans which ran out at now, and forgets failures older
+// than FindTime. It is called every 10 seconds.
+func (b *Banner) Expire(now time.Time) {
+	var ended []Ban
+	b.mu.Lock()
+	for ip, ban := range b.bans {
+		if !now.Before(ban.Until) {
+			ended = append(ended, *ban)
+			delete(b.bans, ip)
+			b.queue("unban", ip)
+		}
+	}
+	for ip, times := range b.failures {
+		if now.Sub(times[len(times)-1]) > b.opts.FindTime {
+			delete(b.failures, ip)
+		}
+	}
+	b.mu.Unlock()
+
+	if len(ended) > 0 {
+		b.changed()
+	}
+	for _, ban := range ended {
+		if b.opts.OnUnban != nil {
+			b.opts.OnUnban(ban)
+		}
+	}
+}
+
+func (b *Banner) unbanned(ban Ban) {
+	b.changed()
+	if b.opts.OnUnban != nil {
+		b.opts.OnUnban(ban)
+	}
+}
+
+// List returns the banned addresses, ordered by the start of their ban.
+func (b *Banner) List() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		list = append(list, *ban)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Start.Equal(list[j].Start) {
+			return list[i].Start.Before(list[j].Start)
+		}
+		return list[i].IP < list[j].IP
+	})
+	return list
+}
+
+// changed updates the files after bans or unbans.
+func (b *Banner) changed() {
+	if err := b.writeFile(); err != nil {
+		fmt.Printf("Writing ban file %s failed: %v\n", b.opts.File, err)
+	}
+	if err := b.saveState(); err != nil {
+		fmt.Printf("Writing ban state %s failed: %v\n", b.opts.StateFile, err)
+	}
+}
+
+// queue queues a run of the command, b.mu must be held so commands run in
+// the order of the changes.
+func (b *Banner) queue(action, ip string) {
+	if len(b.opts.Command) == 0 {
+		return
+	}
+	b.commands = append(b.commands, command{action, ip})
+	select {
+	case b.wake <- true:
+	default:
+	}
+}
+
+// runner runs the queued commands one at a time.
+func (b *Banner) runner() {
+	for range b.wake {
+		for {
+			b.mu.Lock()
+			if len(b.commands) == 0 {
+				b.mu.Unlock()
+				break
+			}
+			c := b.commands[0]
+			b.commands = b.commands[1:]
+			b.mu.Unlock()
+			b.run(c.action, c.ip)
+		}
+	}
+}
+
+func (b *Banner) run(action, ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	args := append(append([]string(nil), b.opts.Command[1:]...), action, ip)
+	out, err := exec.CommandContext(ctx, b.opts.Command[0], args...).CombinedOutput()
+	if err != nil {
+		fmt.Printf("Ban command %s %s %s failed: %v: %s\n", b.opts.Command[0], action, ip, err, strings.TrimSpace(string(out)))
+	}
+}
+
+// writeFile replaces the file with the current bans.
+func (b *Banner) writeFile() error {
+	if b.opts.File == "" {
+		return nil
+	}
+	b.fileMu.Lock()
+	defer b.fileMu.Unlock()
+
+	var v4, v6 []string
+	for _, ban := range b.List() {
+		if strings.Contains(ban.IP, ":") {
+			v6 = append(v6, ban.IP)
+		} else {
+			v4 = append(v4, ban.IP)
+		}
+	}
+	return replaceFile(b.opts.File, []byte(b.format(v4, v6)))
+}
+
+// saveState replaces the state file with the current bans.
+func (b *Banner) saveState() error {
+	if b.opts.StateFile == "" {
+		return nil
+	}
+	b.fileMu.Lock()
+	defer b.fileMu.Unlock()
+
+	data, err := json.Marshal(b.List())
+	if err != nil {
+		return err
+	}
+	return replaceFile(b.opts.StateFile, data)
+}
+
+// replaceFile writes a new file and renames it to fn, so readers never
+// see a partial file.
+func replaceFile(fn string, data []byte) error {
+	dir, base := filepath.Split(fn)
+	f, err := ioutil.TempFile(dir, "."+base)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+// format returns the file contents for the IPv4 and IPv6 addresses.
+func (b *Banner) format(v4, v6 []string) string {
+	var sb strings.Builder
+	switch b.opts.Format {
+	case FormatIPSet:
+		for _, set := range []struct {
+			name, family string
+			ips          []string
+		}{{b.opts.Set, "inet", v4}, {b.opts.Set + "6", "inet6", v6}} {
+			fmt.Fprintf(&sb, "create %s hash:ip family %s -exist\n", set.name, set.family)
+			fmt.Fprintf(&sb, "flush %s\n", set.name)
+			for _, ip := range set.ips {
+				fmt.Fprintf(&sb, "add %s %s\n", set.name, ip)
+			}
+		}
+	case FormatNftables:
+		for _, set := range []struct {
+			name string
+			ips  []string
+		}{{b.opts.Set, v4}, {b.opts.Set + "6", v6}} {
+			fmt.Fprintf(&sb, "flush set %s\n", set.name)
+			if len(set.ips) > 0 {
+				fmt.Fprintf(&sb, "add element %s { %s }\n", set.name, strings.Join(set.ips, ", "))
+			}
+		}
+	default:
+		for _, ip := range append(v4, v6...) {
+			sb.WriteString(ip + "\n")
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,155 @@
+package ban
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "bans")
+
+	_, local, _ := net.ParseCIDR("10.0.0.0/8")
+	var unbans []Ban
+	b, err := newBanner(Options{
+		MaxRetry: 3,
+		FindTime: time.Minute,
+		BanTime:  time.Hour,
+		Ignore:   []*net.IPNet{local},
+		File:     fn,
+		Format:   FormatIPSet,
+		OnUnban:  func(ban Ban) { unbans = append(unbans, ban) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2016, 3, 12, 10, 0, 0, 0, time.UTC)
+	fail := func(ip string, sec int) bool {
+		_, banned := b.Fail(ip, "ssh", "web1", t0.Add(time.Duration(sec)*time.Second))
+		return banned
+	}
+
+	// Failures outside the window don't count.
+	if fail("192.0.2.1", 0) || fail("192.0.2.1", 50) || fail("192.0.2.1", 100) {
+		t.Fatal("Banned with failures spread over more than the window")
+	}
+	if !fail("192.0.2.1", 110) {
+		t.Fatal("Expected a ban after 3 failures within the window")
+	}
+	if fail("192.0.2.1", 111) {
+		t.Error("Expected a banned address not to be banned again")
+	}
+	for i := 0; i < 5; i++ {
+		if fail("10.1.2.3", i) || fail("not an ip", i) {
+			t.Fatal("Expected ignored and invalid addresses not to be banned")
+		}
+	}
+	fail("2001:db8::1", 0)
+	fail("2001:db8::1", 1)
+	fail("2001:db8:0::1", 2)
+
+	list := b.List()
+	if len(list) != 2 || list[0].IP != "2001:db8::1" || list[1].IP != "192.0.2.1" {
+		t.Fatalf("Unexpected bans %+v", list)
+	}
+	if !list[1].Until.Equal(t0.Add(110*time.Second + time.Hour)) {
+		t.Errorf("Unexpected end of ban %v", list[1].Until)
+	}
+
+	content, _ := ioutil.ReadFile(fn)
+	expected := `create gosyslogd hash:ip family inet -exist
+flush gosyslogd
+add gosyslogd 192.0.2.1
+create gosyslogd6 hash:ip family inet6 -exist
+flush gosyslogd6
+add gosyslogd6 2001:db8::1
+`
+	if string(content) != expected {
+		t.Errorf("Unexpected ban file:\n%s", content)
+	}
+
+	b.Expire(t0.Add(time.Hour + 10*time.Second))
+	if len(unbans) != 1 || unbans[0].IP != "2001:db8::1" {
+		t.Fatalf("Expected the first ban to expire, got %+v", unbans)
+	}
+	if !b.Unban("192.0.2.1") || len(b.List()) != 0 {
+		t.Fatal("Expected the ban to be removed")
+	}
+	b.opts.Format = FormatNftables
+	b.opts.Set = "inet filter bans"
+	b.writeFile()
+	content, _ = ioutil.ReadFile(fn)
+	if string(content) != "flush set inet filter bans\nflush set inet filter bans6\n" {
+		t.Errorf("Unexpected empty nftables file:\n%s", content)
+	}
+}
+
+func TestCommandsAndState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+	opts := Options{
+		MaxRetry:  1,
+		StateFile: filepath.Join(dir, "state"),
+		Command:   []string{"sh", "-c", `echo "$0 $1" >> ` + log},
+	}
+
+	// waitFor waits until the command ran n times and returns its runs.
+	waitFor := func(n int) []string {
+		var lines []string
+		for i := 0; i < 500; i++ {
+			b, _ := ioutil.ReadFile(log)
+			lines = strings.Split(strings.TrimSpace(string(b)), "\n")
+			if len(lines) >= n {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return lines
+	}
+
+	b, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	past := now.Add(-24 * time.Hour)
+	b.Fail("192.0.2.1", "ssh", "web1", now)
+	b.Fail("192.0.2.2", "ssh", "web1", past)
+	b.Fail("192.0.2.3", "ssh", "web1", now)
+	b.Unban("192.0.2.1")
+	b.Fail("192.0.2.1", "ssh", "web1", now)
+
+	expected := "ban 192.0.2.1,ban 192.0.2.2,ban 192.0.2.3,unban 192.0.2.1,ban 192.0.2.1"
+	if lines := waitFor(5); strings.Join(lines, ",") != expected {
+		t.Fatalf("Expected commands in order, got %q", lines)
+	}
+
+	// After a restart active bans are restored, ended ones unbanned.
+	os.Remove(log)
+	b, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := b.List()
+	if len(list) != 2 || list[0].IP != "192.0.2.1" || list[1].IP != "192.0.2.3" || !list[1].Start.Equal(now) {
+		t.Fatalf("Expected the active bans to be restored, got %+v", list)
+	}
+	expected = "unban 192.0.2.2,ban 192.0.2.1,ban 192.0.2.3"
+	if lines := waitFor(3); strings.Join(lines, ",") != expected {
+		t.Fatalf("Expected bans to be restored, got %q", lines)
+	}
+}
@@ -0,0 +1,148 @@
+// Package bundle collects the context of important messages: the lines of
+// the same host leading up to a match, and the lines which follow it for a
+// while, like the contexts of logsurfer.
+//
+// Example
+//
+//	c := bundle.New(bundle.Options{After: time.Minute, OnBundle: func(b *bundle.Bundle) { ... }})
+//	for m := range messages {
+//		c.Add(m)
+//		if important {
+//			c.Start(rule, m, lastLinesOfHost)
+//		}
+//	}
+package bundle
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// Options contain the configuration of a Collector.
+type Options struct {
+	// After is how long lines following a match are collected, default
+	// 30 seconds.
+	After time.Duration
+	// MaxAfter limits the number of following lines, default 100. The
+	// bundle is finished early when it is reached.
+	MaxAfter int
+	// OnBundle is called with every finished bundle.
+	OnBundle func(b *Bundle)
+}
+
+// Bundle is an important message with the lines of its host around it.
+type Bundle struct {
+	Rule    string
+	Md5     string
+	Host    string
+	Message *syslogd.Message
+	// Before and After are the lines of the host before and after the
+	// message, oldest first.
+	Before []*syslogd.Message
+	After  []*syslogd.Message
+}
+
+// Lines returns the raw lines of the bundle in order.
+func (b *Bundle) Lines() []string {
+	var lines []string
+	for _, m := range b.Before {
+		lines = append(lines, string(m.Raw))
+	}
+	lines = append(lines, string(b.Message.Raw))
+	for _, m := range b.After {
+		lines = append(lines, string(m.Raw))
+	}
+	return lines
+}
+
+// Collector collects bundles. It is safe for concurrent use.
+type Collector struct {
+	opts Options
+	open map[string]*pending
+	mu   sync.Mutex
+}
+
+type pending struct {
+	b     *Bundle
+	timer *time.Timer
+}
+
+// New creates a Collector.
+func New(opts Options) *Collector {
+	if opts.After == 0 {
+		opts.After = 30 * time.Second
+	}
+	if opts.MaxAfter == 0 {
+		opts.MaxAfter = 100
+	}
+	return &Collector{opts: opts, open: make(map[string]*pending)}
+}
+
+// Start starts a bundle for a message matched by rule e. Before are the
+// preceding lines of the host, newest first as returned by cycbuf, m
+// itself is left out. While a bundle of the same rule and host is being
+// collected no new one is started, m is part of the open bundle instead.
+func (c *Collector) Start(e *parser.Logent, m *syslogd.Message, before []*syslogd.Message) bool {
+	key := m.Hostname + "\x00" + e.Md5 + "\x00" + e.ID
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, x := c.open[key]; x {
+		return false
+	}
+
+	b := &Bundle{Rule: e.ID, Md5: e.Md5, Host: m.Hostname, Message: m}
+	for i := len(before) - 1; i >= 0; i-- {
+		if before[i] != m {
+			b.Before = append(b.Before, before[i])
+		}
+	}
+	p := &pending{b: b}
+	p.timer = time.AfterFunc(c.opts.After, func() { c.finish(key, p) })
+	c.open[key] = p
+	return true
+}
+
+// Add adds a message to the open bundles of its host. It must be called for
+// every message, before Start is called for it.
+func (c *Collector) Add(m *syslogd.Message) {
+	var full []string
+
+	c.mu.Lock()
+	for key, p := range c.open {
+		if p.b.Host != m.Hostname {
+			continue
+		}
+		p.b.After = append(p.b.After, m)
+		if len(p.b.After) >= c.opts.MaxAfter {
+			full = append(full, key)
+		}
+	}
+	var done []*pending
+	for _, key := range full {
+		p := c.open[key]
+		if p.timer.Stop() {
+			delete(c.open, key)
+			done = append(done, p)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, p := range done {
+		c.opts.OnBundle(p.b)
+	}
+}
+
+func (c *Collector) finish(key string, p *pending) {
+	c.mu.Lock()
+	if c.open[key] != p {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.open, key)
+	c.mu.Unlock()
+	c.opts.OnBundle(p.b)
+}
@@ -0,0 +1,55 @@
+package bundle
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+func TestBundle(t *testing.T) {
+	bundles := make(chan *Bundle, 10)
+	c := New(Options{After: 50 * time.Millisecond, MaxAfter: 3, OnBundle: func(b *Bundle) { bundles <- b }})
+	e := &parser.Logent{ID: "oops", Md5: "x"}
+
+	msg := func(host, text string) *syslogd.Message {
+		return &syslogd.Message{Hostname: host, Raw: []byte(text)}
+	}
+
+	// Newest first, like cycbuf.
+	trigger := msg("web1", "oops")
+	before := []*syslogd.Message{trigger, msg("web1", "2"), msg("web1", "1")}
+	c.Add(trigger)
+	if !c.Start(e, trigger, before) {
+		t.Fatal("Expected a bundle to start")
+	}
+	c.Add(msg("db1", "other host"))
+	c.Add(msg("web1", "3"))
+	again := msg("web1", "oops")
+	c.Add(again)
+	if c.Start(e, again, nil) {
+		t.Fatal("Expected no second bundle while one is open")
+	}
+
+	b := <-bundles
+	if got := strings.Join(b.Lines(), ","); got != "1,2,oops,3,oops" {
+		t.Errorf("Unexpected lines %s", got)
+	}
+
+	// Bundles end early when they are full.
+	c.Start(e, trigger, nil)
+	for i := 0; i < 3; i++ {
+		c.Add(msg("web1", fmt.Sprint(i)))
+	}
+	select {
+	case b := <-bundles:
+		if len(b.After) != 3 {
+			t.Errorf("Expected 3 lines after, got %d", len(b.After))
+		}
+	case <-time.After(20 * time.Millisecond):
+		t.Error("Expected a full bundle to finish early")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tomarus/gosyslogd/bundle"
+	"github.com/tomarus/gosyslogd/expect"
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// handleMatch runs the actions of a matched rule. Unless the rule is
+// ignored the message is also kept in the cyclic buffer of the rule.
+// Rules with a threshold only run their actions when it is crossed, and
+// publish the event to the "alerts" channel.
+func handleMatch(e *parser.Logent, m *syslogd.Message) {
+	if e.Transaction != nil {
+		trans.Add(e, m, m.Received)
+	}
+	if e.Expect != nil {
+		watch.Seen(e, m, m.Received)
+	}
+	if e.Threshold != nil {
+		ev, fired := corr.Add(e, m, m.Received)
+		if !fired {
+			cyc.Add(e.Md5, m)
+			return
+		}
+		publishEvent("alerts", ev)
+	}
+	if bundles != nil && e.Important >= cfg.Context.Level {
+		bundles.Start(e, m, cyc.LastString(m.Hostname, cfg.Context.Before+1))
+	}
+
+	keep := true
+	for _, a := range e.Actions {
+		switch a.Type {
+		case parser.ActionIgnore:
+			keep = false
+		case parser.ActionStore:
+			store(e, m)
+		case parser.ActionPublish:
+			publish(a.Arg, e, m)
+		case parser.ActionAlert:
+			store(e, m)
+			publish("critical", e, m)
+		case parser.ActionBan:
+			banFailure(a, e, m)
+		case parser.ActionExec:
+			execute(a, e, m)
+		}
+	}
+	if keep {
+		cyc.Add(e.Md5, m)
+	}
+}
+
+func store(e *parser.Logent, m *syslogd.Message) {
+	if cfg.Postgres != "" {
+		psql.AddUnhandled(e.Md5, string(m.Raw), m.Fields)
+	}
+}
+
+// publish publishes the raw message to a Redis channel, and the message
+// including its extracted fields as JSON to the channel suffixed with ".json".
+func publish(channel string, e *parser.Logent, m *syslogd.Message) {
+	rdb.Do("PUBLISH", channel, m.Raw)
+
+	b, err := json.Marshal(struct {
+		Md5  string
+		Rule string
+		*syslogd.Message
+	}{e.Md5, e.ID, m})
+	if err != nil {
+		fmt.Printf("Can't encode message: %v\n", err)
+		return
+	}
+	rdb.Do("PUBLISH", channel+".json", b)
+}
+
+// missed alerts that an expected message did not arrive. The alert is a
+// message of gosyslogd itself, stored and published like the alert action.
+func missed(x expect.Missed) {
+	host := x.Host
+	if host == "" {
+		host = "-"
+	}
+	last := "never"
+	if !x.Last.IsZero() {
+		last = x.Last.Format(time.RFC3339)
+	}
+	now := time.Now()
+	raw := fmt.Sprintf("%s %s gosyslogd: Expected message of rule %s (%s) did not arrive, last seen %s",
+		now.Format(time.RFC3339), host, x.ID, x.Expected, last)
+	m := &syslogd.Message{
+		Received: now,
+		Time:     now,
+		Priority: syslogd.NoPriority,
+		Hostname: x.Host,
+		Tag:      "gosyslogd",
+		Raw:      []byte(raw),
+	}
+	store(x.Rule, m)
+	publish("critical", x.Rule, m)
+}
+
+// emitBundle publishes the context of an important match as JSON to Redis
+// channel "critical.context" and stores its lines as a single message.
+func emitBundle(b *bundle.Bundle) {
+	publishEvent("critical.context", b)
+	if cfg.Postgres != "" {
+		psql.AddUnhandled(b.Md5, strings.Join(b.Lines(), "\n"), map[string]string{"context": b.Host})
+	}
+}
+
+// publishEvent publishes an event as JSON to a Redis channel.
+func publishEvent(channel string, ev interface{}) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		fmt.Printf("Can't encode event: %v\n", err)
+		return
+	}
+	rdb.Do("PUBLISH", channel, b)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tomarus/gosyslogd/ban"
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// banConfig configures banning addresses with the ban action.
+type banConfig struct {
+	// MaxRetry failures within FindTime seconds ban an address for BanTime
+	// seconds, default 5 in 600 seconds for 3600 seconds.
+	MaxRetry int `json:"maxretry"`
+	FindTime int `json:"findtime"`
+	BanTime  int `json:"bantime"`
+	// Ignore contains addresses and networks which are never banned.
+	Ignore []string `json:"ignore"`
+	// File is written in Format, "plain", "ipset" or "nftables", with Set
+	// as the name of the set.
+	File    string   `json:"file"`
+	Format  string   `json:"format"`
+	Set     string   `json:"set"`
+	Command []string `json:"command"`
+	// State is the file the bans are kept in across restarts.
+	State string `json:"state"`
+}
+
+// newBanner creates the banner of the ban action from the configuration.
+func newBanner(c *banConfig) (*ban.Banner, error) {
+	if c == nil {
+		c = &banConfig{}
+	}
+	opts := ban.Options{
+		MaxRetry:  c.MaxRetry,
+		FindTime:  time.Duration(c.FindTime) * time.Second,
+		BanTime:   time.Duration(c.BanTime) * time.Second,
+		File:      c.File,
+		Format:    c.Format,
+		Set:       c.Set,
+		Command:   c.Command,
+		StateFile: c.State,
+		OnBan:     func(b ban.Ban) { publishEvent("bans", banEvent{"ban", b}) },
+		OnUnban:   func(b ban.Ban) { publishEvent("bans", banEvent{"unban", b}) },
+	}
+	for _, s := range c.Ignore {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ban ignore address: %v", err)
+		}
+		opts.Ignore = append(opts.Ignore, n)
+	}
+	return ban.New(opts)
+}
+
+// banEvent is published to Redis channel "bans".
+type banEvent struct {
+	Action string
+	ban.Ban
+}
+
+// banFailure counts a failure of the address in the capture group of a
+// ban action.
+func banFailure(a parser.Action, e *parser.Logent, m *syslogd.Message) {
+	if ip := m.Fields[a.Arg]; ip != "" {
+		banner.Fail(ip, e.ID, m.Hostname, m.Received)
+	}
+}
+
+// httpBans serves the banned addresses as JSON. A DELETE request with
+// parameter ip unbans that address, it is only accepted from the local
+// host as the web interface has no authentication.
+func httpBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			http.Error(w, "Bans can only be lifted from the local host.", http.StatusForbidden)
+			return
+		}
+		if !banner.Unban(r.FormValue("ip")) {
+			http.Error(w, "Address is not banned.", http.StatusNotFound)
+		}
+		return
+	}
+	writeJSON(w, banner.List())
+}
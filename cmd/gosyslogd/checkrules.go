@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tomarus/gosyslogd/parser"
+)
+
+// checkRules implements the "check-rules" subcommand which lints the rule
+// files and runs their examples, see parser.Lint. It fails on errors, and
+// on warnings too if -strict is given.
+func checkRules(args []string) error {
+	fs := flag.NewFlagSet("check-rules", flag.ExitOnError)
+	rules := fs.String("rules", "", "Rules directory (default rules from config).")
+	strict := fs.Bool("strict", false, "Fail on warnings too.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gosyslogd check-rules [options]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := loadConfig(); err != nil && *rules == "" {
+		return err
+	}
+	if *rules == "" {
+		*rules = cfg.RulesDir
+	}
+
+	problems, err := parser.Lint(parserOptions(*rules))
+	if err != nil {
+		return err
+	}
+
+	errors, warnings := 0, 0
+	for _, p := range problems {
+		fmt.Println(p)
+		if p.Fatal {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+	if errors > 0 || (*strict && warnings > 0) {
+		return fmt.Errorf("%d errors, %d warnings", errors, warnings)
+	}
+	fmt.Printf("Rules in %s are OK, %d warnings.\n", *rules, warnings)
+	return nil
+}
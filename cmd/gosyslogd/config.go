@@ -4,7 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+
+	"github.com/tomarus/gosyslogd/packs"
+	"github.com/tomarus/gosyslogd/parser"
 )
 
 // Path to JSON config files, first one found is used.
@@ -25,6 +30,78 @@ type config struct {
 	Redis    string `json:"redis"`
 	Postgres string `json:"postgres"`
 	HTTP     string `json:"http"`
+
+	HostGroups   map[string][]string `json:"hostgroups"`
+	TagNormalize []string            `json:"tagnormalize"`
+
+	// RulePacks lists the built in rule packs loaded alongside the rules
+	// directory, "all" for all of them.
+	RulePacks []string `json:"rulepacks"`
+
+	ArchivePriority bool   `json:"archivepri"`
+	ArchiveChain    bool   `json:"archivechain"`
+	ArchiveKey      string `json:"archivekey"`
+	ArchiveInterval int    `json:"archiveinterval"`
+	IndexLines      int    `json:"indexlines"`
+	IndexInterval   int    `json:"indexinterval"`
+
+	Upload *uploadConfig `json:"upload"`
+
+	// Workers is the number of goroutines processing messages, default 1.
+	// ShardBy is "host" or "tag", messages with the same host or tag are
+	// processed by the same worker in order.
+	Workers int    `json:"workers"`
+	ShardBy string `json:"shardby"`
+
+	// RuleStats is the file the rule statistics are saved to.
+	RuleStats string `json:"rulestats"`
+
+	Context *contextConfig `json:"context"`
+
+	// TransactionTimeout ends transactions idle for this many seconds,
+	// default 600.
+	TransactionTimeout int `json:"transactiontimeout"`
+
+	// AnomalySigma is the number of standard deviations a message rate
+	// must differ from its baseline to be an anomaly, default 4.
+	// AnomalyState is the file the baselines are saved to.
+	AnomalySigma float64 `json:"anomalysigma"`
+	AnomalyState string  `json:"anomalystate"`
+
+	Ban *banConfig `json:"ban"`
+
+	// Commands can be run by the exec action, at most ExecConcurrency at
+	// once, default 4.
+	Commands        []commandConfig `json:"commands"`
+	ExecConcurrency int             `json:"execconcurrency"`
+
+	Dedup *dedupConfig `json:"dedup"`
+}
+
+// contextConfig configures collecting the lines around important matches.
+type contextConfig struct {
+	// Before is the number of preceding lines of the host, default 20.
+	Before int `json:"before"`
+	// After is the number of seconds following lines are collected,
+	// default 30, up to MaxAfter lines, default 100.
+	After    int `json:"after"`
+	MaxAfter int `json:"maxafter"`
+	// Level is the minimum level of rules to collect context for,
+	// default 2 (critical).
+	Level int `json:"level"`
+}
+
+// uploadConfig configures shipping archive files of past days to
+// S3 compatible object storage.
+type uploadConfig struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"accesskey"`
+	SecretKey string `json:"secretkey"`
+	Compress  bool   `json:"compress"`
+	Delete    bool   `json:"delete"`
 }
 
 var cfg config
@@ -58,6 +135,42 @@ func loadConfig() error {
 	if err != nil {
 		return err
 	}
+	if cfg.ShardBy != "" && cfg.ShardBy != "host" && cfg.ShardBy != "tag" {
+		return fmt.Errorf("Invalid shardby %q, expected host or tag.", cfg.ShardBy)
+	}
+	if _, err := packs.Get(cfg.RulePacks...); err != nil {
+		return err
+	}
 
 	return nil
 }
+
+// parserOptions returns the parser configuration for rules directory path.
+func parserOptions(path string) parser.Options {
+	// The packs were checked when loading the configuration.
+	rp, _ := packs.Get(cfg.RulePacks...)
+	var commands []string
+	for _, c := range cfg.Commands {
+		commands = append(commands, c.Name)
+	}
+	return parser.Options{
+		Path:       path,
+		HostGroups: cfg.HostGroups,
+		Commands:   commands,
+		Normalize:  cfg.TagNormalize,
+		Packs:      rp,
+	}
+}
+
+// archiveKey reads the hash chain key from the file configured as
+// "archivekey". Returns nil if no key file is configured.
+func archiveKey() ([]byte, error) {
+	if cfg.ArchiveKey == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(cfg.ArchiveKey)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(b), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"time"
+
+	"github.com/tomarus/gosyslogd/dedup"
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// dedupConfig configures collapsing repeated messages.
+type dedupConfig struct {
+	// Window is the number of seconds repeats are collapsed in, 0 to only
+	// collapse repeats of the tags in Tags and of rules with a dedup
+	// setting.
+	Window int `json:"window"`
+	// Tags overrides Window per tag, 0 disables deduplication of a tag.
+	Tags map[string]int `json:"tags"`
+}
+
+// dedupWindow returns the window repeats of m, matched by rule e or nil,
+// are collapsed in, 0 if they are not. The setting of the rule overrides
+// the one of the tag. Rules with a threshold are never deduplicated, their
+// actions only run when the threshold is crossed.
+func dedupWindow(e *parser.Logent, m *syslogd.Message) time.Duration {
+	if cfg.Dedup == nil || (e != nil && e.Threshold != nil) {
+		return 0
+	}
+	if e != nil && e.Dedup != nil {
+		return *e.Dedup
+	}
+	if w, x := cfg.Dedup.Tags[m.Tag]; x {
+		return time.Duration(w) * time.Second
+	}
+	return time.Duration(cfg.Dedup.Window) * time.Second
+}
+
+// handleRepeat handles a suppressed repeat of a message matched by rule e.
+// It is only stored and published as part of its summary, but
+// transactions, expectations and bans still see every match. Repeats of
+// monitored unmatched messages are still passed to the miner.
+func handleRepeat(e *parser.Logent, m *syslogd.Message) {
+	if e.Transaction != nil {
+		trans.Add(e, m, m.Received)
+	}
+	if e.Expect != nil {
+		watch.Seen(e, m, m.Received)
+	}
+	for _, a := range e.Actions {
+		if a.Type == parser.ActionBan {
+			banFailure(a, e, m)
+		}
+	}
+}
+
+// emitSummary stores and publishes the summary of repeated messages like
+// the first of them. Only store, publish and alert actions run for the
+// summary, summaries of unmonitored messages are only kept in memory.
+func emitSummary(s dedup.Summary) {
+	m := s.Repeated()
+	cyc.AddString(m.Tag, m)
+	cyc.AddString(m.Hostname, m)
+	cyc.AddString(m.PriorityString(), m)
+	if !s.Monitored {
+		return
+	}
+
+	e := s.Rule
+	if e == nil {
+		if cfg.Postgres != "" {
+			psql.AddUnhandled(nullmd5, string(m.Raw), m.Fields)
+		}
+		cyc.Add(nullmd5, m)
+		rdb.Do("PUBLISH", "logging", m.Raw)
+		return
+	}
+
+	keep := true
+	for _, a := range e.Actions {
+		switch a.Type {
+		case parser.ActionIgnore:
+			keep = false
+		case parser.ActionStore:
+			store(e, m)
+		case parser.ActionPublish:
+			publish(a.Arg, e, m)
+		case parser.ActionAlert:
+			store(e, m)
+			publish("critical", e, m)
+		}
+	}
+	if keep {
+		cyc.Add(e.Md5, m)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/runner"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// commandConfig configures a command of the exec action.
+type commandConfig struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+	Dir  string   `json:"dir"`
+	User string   `json:"user"`
+	// Timeout is in seconds, default 10. Rate is the maximum number of
+	// runs per minute. MaxMemory is in megabytes.
+	Timeout   int `json:"timeout"`
+	Rate      int `json:"rate"`
+	MaxOutput int `json:"maxoutput"`
+	MaxMemory int `json:"maxmemory"`
+	MaxFiles  int `json:"maxfiles"`
+}
+
+// newRunner creates the runner of the exec action from the configuration
+// and exposes its statistics as expvar "exec_stats".
+func newRunner() (*runner.Runner, error) {
+	opts := runner.Options{
+		Concurrency: cfg.ExecConcurrency,
+		OnResult:    execResult,
+	}
+	for _, c := range cfg.Commands {
+		opts.Commands = append(opts.Commands, runner.Command{
+			Name:      c.Name,
+			Args:      c.Args,
+			Dir:       c.Dir,
+			User:      c.User,
+			Timeout:   time.Duration(c.Timeout) * time.Second,
+			Rate:      c.Rate,
+			MaxOutput: c.MaxOutput,
+			MaxMemory: int64(c.MaxMemory) << 20,
+			MaxFiles:  c.MaxFiles,
+		})
+	}
+	r, err := runner.New(opts)
+	if err != nil {
+		return nil, err
+	}
+	expvar.Publish("exec_stats", expvar.Func(func() interface{} {
+		return r.Stats()
+	}))
+	return r, nil
+}
+
+// execute runs the command of an exec action. The raw message is passed on
+// stdin, the message and its fields in the environment:
+//
+//	GOSYSLOGD_RULE       id of the rule
+//	GOSYSLOGD_HOST       hostname
+//	GOSYSLOGD_TAG        tag
+//	GOSYSLOGD_PRIORITY   priority, e.g. auth.warning
+//	GOSYSLOGD_MESSAGE    raw message
+//	GOSYSLOGD_FIELD_IP   extracted field ip, names are upper cased
+func execute(a parser.Action, e *parser.Logent, m *syslogd.Message) {
+	env := []string{
+		"GOSYSLOGD_RULE=" + e.ID,
+		"GOSYSLOGD_HOST=" + m.Hostname,
+		"GOSYSLOGD_TAG=" + m.Tag,
+		"GOSYSLOGD_PRIORITY=" + m.PriorityString(),
+		"GOSYSLOGD_MESSAGE=" + string(m.Raw),
+	}
+	fields := make([]string, 0, len(m.Fields))
+	for f := range m.Fields {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		env = append(env, "GOSYSLOGD_FIELD_"+envName(f)+"="+m.Fields[f])
+	}
+	if err := exe.Run(a.Arg, env, []byte(string(m.Raw)+"\n")); err != nil {
+		fmt.Printf("Can't run command %s of rule %s: %v\n", a.Arg, e.ID, err)
+	}
+}
+
+// envName upper cases a field name and replaces characters which are not
+// allowed in environment variable names.
+func envName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// execResult logs failed runs.
+func execResult(r runner.Result) {
+	if r.ExitCode != 0 {
+		fmt.Printf("Command %s failed with exit code %d: %s %s\n", r.Command, r.ExitCode, r.Error, strings.TrimSpace(r.Output))
+	}
+}
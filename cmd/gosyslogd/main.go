@@ -7,12 +7,23 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	_ "github.com/lib/pq"
+	"github.com/tomarus/gosyslogd/anomaly"
+	"github.com/tomarus/gosyslogd/ban"
+	"github.com/tomarus/gosyslogd/bundle"
+	"github.com/tomarus/gosyslogd/correlate"
 	"github.com/tomarus/gosyslogd/cycbuf"
+	"github.com/tomarus/gosyslogd/dedup"
+	"github.com/tomarus/gosyslogd/expect"
+	"github.com/tomarus/gosyslogd/miner"
 	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/runner"
 	"github.com/tomarus/gosyslogd/syslogd"
+	"github.com/tomarus/gosyslogd/transaction"
+	"github.com/tomarus/gosyslogd/upload"
 	"golang.org/x/net/websocket"
 )
 
@@ -21,9 +32,19 @@ var rdb redis.Conn
 var sys *syslogd.Server
 var cyc *cycbuf.Cycbuf
 var stats *sysstats
+var mine *miner.Miner
+var corr *correlate.Engine
+var bundles *bundle.Collector
+var trans *transaction.Tracker
+var watch *expect.Watcher
+var rates *anomaly.Detector
+var banner *ban.Banner
+var exe *runner.Runner
+var dedups *dedup.Deduper
 
 var verbose = flag.Bool("v", false, "Log all unwanted messages to stdout.")
 var tail = flag.Bool("tail", false, "Tail -f the unwanted log connecting to a running gosyslogd.")
+var verifyArchive = flag.Bool("verify-archive", false, "Verify the hash chain of the archive files given as arguments.")
 
 const nullmd5 = "00000000000000000000000000000000"
 
@@ -32,12 +53,46 @@ func main() {
 
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "search":
+		if err := search(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "replay":
+		if err := replay(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "check-rules":
+		if err := checkRules(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "rule-report":
+		if err := ruleReport(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Load config.
 	err = loadConfig()
 	if err != nil {
 		panic(err)
 	}
 
+	if *verifyArchive {
+		if !verify(flag.Args()) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Connect to Redis.
 	rdb, err = redis.Dial("tcp", cfg.Redis)
 	if err != nil {
@@ -51,8 +106,16 @@ func main() {
 		return
 	}
 
+	// Shared by all workers.
+	rdb = &lockedConn{Conn: rdb}
+
+	stats = newStats()
+
 	// Load logsurfer filtering rules.
-	parse, err = parser.New(cfg.RulesDir)
+	opts := parserOptions(cfg.RulesDir)
+	opts.OnReload = stats.Reload
+	opts.StatsFile = cfg.RuleStats
+	parse, err = parser.NewWithOptions(opts)
 	if err != nil {
 		panic(err)
 	}
@@ -68,7 +131,63 @@ func main() {
 	// Initialize in memory cyclic buffer cache.
 	cyc = cycbuf.New()
 
-	stats = newStats()
+	// Collect templates of unmatched messages.
+	mine = miner.New(miner.Options{})
+
+	// Count matches of rules with a threshold.
+	corr = correlate.New()
+
+	// Group matches into transactions.
+	trans = transaction.New(transaction.Options{
+		Timeout: time.Duration(cfg.TransactionTimeout) * time.Second,
+		OnEnd:   storeTransaction,
+	})
+
+	// Alert when expected messages do not arrive.
+	watch = expect.New(expect.Options{Rules: parse.Rules, OnMissed: missed})
+
+	// Detect floods and drops of messages of tags and hosts.
+	rates, err = anomaly.New(anomaly.Options{
+		Sigma:     cfg.AnomalySigma,
+		StateFile: cfg.AnomalyState,
+		OnAnomaly: func(ev anomaly.Event) { publishEvent("anomalies", ev) },
+	})
+	if err != nil {
+		panic(err)
+	}
+	stats.Anomalies(rates)
+
+	// Ban addresses of ban actions.
+	banner, err = newBanner(cfg.Ban)
+	if err != nil {
+		panic(err)
+	}
+
+	// Run commands of exec actions.
+	exe, err = newRunner()
+	if err != nil {
+		panic(err)
+	}
+
+	// Collapse repeated messages.
+	if cfg.Dedup != nil {
+		dedups = dedup.New(dedup.Options{OnSummary: emitSummary})
+	}
+
+	// Collect the context of important matches.
+	if cfg.Context != nil {
+		if cfg.Context.Before == 0 {
+			cfg.Context.Before = 20
+		}
+		if cfg.Context.Level == 0 {
+			cfg.Context.Level = 2
+		}
+		bundles = bundle.New(bundle.Options{
+			After:    time.Duration(cfg.Context.After) * time.Second,
+			MaxAfter: cfg.Context.MaxAfter,
+			OnBundle: emitBundle,
+		})
+	}
 
 	// Start HTTP server.
 	go func() {
@@ -80,10 +199,48 @@ func main() {
 
 	// Add last-x log lines output
 	http.HandleFunc("/log", cyc.HttpLog)
+	publishRuleStats()
+	http.HandleFunc("/unmatched/templates", httpTemplates)
+	http.HandleFunc("/transactions", httpTransactions)
+	http.HandleFunc("/bans", httpBans)
 	http.Handle("/stream", websocket.Handler(cyc.HttpStream))
 
 	// Start syslog server.
-	sys = syslogd.NewServer(syslogd.Options{SockAddr: cfg.SockAddr, UnixPath: cfg.UnixPath, LogDir: cfg.LogDir})
+	key, err := archiveKey()
+	if err != nil {
+		panic(err)
+	}
+	var onClose func(string)
+	if cfg.Upload != nil && cfg.LogDir != "" {
+		up, err := upload.New(upload.Options{
+			Endpoint:  cfg.Upload.Endpoint,
+			Region:    cfg.Upload.Region,
+			Bucket:    cfg.Upload.Bucket,
+			Prefix:    cfg.Upload.Prefix,
+			AccessKey: cfg.Upload.AccessKey,
+			SecretKey: cfg.Upload.SecretKey,
+			Compress:  cfg.Upload.Compress,
+			Delete:    cfg.Upload.Delete,
+			LogDir:    cfg.LogDir,
+		})
+		if err != nil {
+			panic(err)
+		}
+		onClose = up.Closed
+	}
+
+	sys = syslogd.NewServer(syslogd.Options{
+		SockAddr:        cfg.SockAddr,
+		UnixPath:        cfg.UnixPath,
+		LogDir:          cfg.LogDir,
+		ArchivePriority: cfg.ArchivePriority,
+		Chain:           cfg.ArchiveChain,
+		ChainKey:        key,
+		ChainInterval:   cfg.ArchiveInterval,
+		IndexLines:      cfg.IndexLines,
+		IndexInterval:   time.Duration(cfg.IndexInterval) * time.Second,
+		OnClose:         onClose,
+	})
 	go sysloop()
 
 	// Wait for ctrl-c
@@ -92,6 +249,11 @@ func main() {
 	<-sig
 
 	sys.Close()
+	trans.Close()
+	parse.Close()
+	if err := parse.SaveStats(); err != nil {
+		fmt.Printf("Can't save rule statistics: %v\n", err)
+	}
 }
 
 func tailf(c redis.Conn) error {
@@ -109,50 +271,77 @@ func tailf(c redis.Conn) error {
 	}
 }
 
+// sysloop reads messages from the syslog server and hands them to the
+// workers. Messages of the same shard are handled in order.
 func sysloop() {
+	pool := newWorkers(cfg.Workers, cfg.ShardBy, handleMessage)
 	for {
 		m := sys.Next()
 		if m == nil {
 			fmt.Printf("No more messages, exiting.\n")
+			pool.close()
 			sys.Close()
 			os.Exit(-1)
 		}
+		pool.add(m)
+	}
+}
 
-		stats.Tag(m.Tag)
-		stats.Host(m.Hostname)
-		stats.Priority(m.PriorityString())
-
-		cyc.AddString(m.Tag, m)
-		cyc.AddString(m.Hostname, m)
-		cyc.AddString(m.PriorityString(), m)
+// handleMessage matches a message and runs the actions of its rule. It is
+// called concurrently by the workers.
+func handleMessage(m *syslogd.Message) {
+	// Match before storing the message so extracted fields are included.
+	monitored := parse.Selects(m)
+	var logent *parser.Logent
+	var matched bool
+	if monitored {
+		logent, m.Fields, matched = parse.CheckMessage(m)
+	}
 
-		// Parser & matching stuff
+	stats.Tag(m.Tag)
+	stats.Host(m.Hostname)
+	stats.Priority(m.PriorityString())
+	rates.Add(m)
 
-		if !parse.HasTag(m.Tag) {
-			continue
+	if dedups != nil {
+		if w := dedupWindow(logent, m); w > 0 && dedups.Add(logent, m, monitored, w, m.Received) {
+			if matched {
+				handleRepeat(logent, m)
+			} else if monitored {
+				mine.Add(m)
+			}
+			return
 		}
+	}
 
-		if logent, x := parse.Check(m.Tag, string(m.Raw)); x {
-			// Mached a regex entry.
-			if logent.Important > 1 {
-				if cfg.Postgres != "" {
-					psql.AddUnhandled(logent.Md5, string(m.Raw))
-				}
-				rdb.Do("PUBLISH", "critical", m.Raw)
-			}
-			cyc.Add(logent.Md5, m)
-		} else {
-			// No match found.
-			if cfg.Postgres != "" {
-				psql.AddUnhandled(nullmd5, string(m.Raw))
-			}
-			cyc.Add(nullmd5, m)
-			rdb.Do("PUBLISH", "logging", m.Raw)
+	if bundles != nil {
+		bundles.Add(m)
+	}
 
-			if *verbose {
-				fmt.Println(string(m.Raw))
-			}
+	cyc.AddString(m.Tag, m)
+	cyc.AddString(m.Hostname, m)
+	cyc.AddString(m.PriorityString(), m)
+
+	// Parser & matching stuff
+
+	if !monitored {
+		return
+	}
+
+	if matched {
+		// Mached a regex entry.
+		handleMatch(logent, m)
+	} else {
+		// No match found.
+		if cfg.Postgres != "" {
+			psql.AddUnhandled(nullmd5, string(m.Raw), nil)
 		}
+		cyc.Add(nullmd5, m)
+		mine.Add(m)
+		rdb.Do("PUBLISH", "logging", m.Raw)
 
+		if *verbose {
+			fmt.Println(string(m.Raw))
+		}
 	}
 }
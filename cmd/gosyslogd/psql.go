@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 type psqlmsg struct {
 	md5     string
 	content string
+	fields  map[string]string
 }
 
 type psqldb struct {
@@ -63,17 +65,27 @@ func (p *psqldb) tables() {
 	}
 
 	if p.table != tn {
-		p.db.Exec(fmt.Sprintf("CREATE TABLE %s (epoch int, match char(32), msg varchar)", tn))
+		p.db.Exec(fmt.Sprintf("CREATE TABLE %s (epoch int, match char(32), msg varchar, fields varchar)", tn))
 		p.db.Exec(fmt.Sprintf("CREATE INDEX epochidx_%s ON %s(epoch)", tn, tn))
 		p.db.Exec(fmt.Sprintf("CREATE INDEX matchidx_%s ON %s(match)", tn, tn))
 	}
+	// Tables created before fields were extracted lack the column.
+	p.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS fields varchar", tn))
 }
 
 func (p *psqldb) msgReader() {
 	for {
 		select {
 		case m := <-p.msgbus:
-			_, err := p.db.Exec(fmt.Sprintf("INSERT INTO %s (epoch, match, msg) VALUES($1,$2,$3)", p.table), time.Now().Unix(), m.md5, m.content)
+			var fields sql.NullString
+			if len(m.fields) > 0 {
+				b, err := json.Marshal(m.fields)
+				if err != nil {
+					panic(err)
+				}
+				fields = sql.NullString{String: string(b), Valid: true}
+			}
+			_, err := p.db.Exec(fmt.Sprintf("INSERT INTO %s (epoch, match, msg, fields) VALUES($1,$2,$3,$4)", p.table), time.Now().Unix(), m.md5, m.content, fields)
 			if err != nil {
 				panic(err)
 			}
@@ -81,7 +93,8 @@ func (p *psqldb) msgReader() {
 	}
 }
 
-func (p *psqldb) AddUnhandled(md5, content string) (err error) {
-	p.msgbus <- &psqlmsg{md5: md5, content: content}
+// AddUnhandled stores a message and its extracted fields, if any.
+func (p *psqldb) AddUnhandled(md5, content string, fields map[string]string) (err error) {
+	p.msgbus <- &psqlmsg{md5: md5, content: content, fields: fields}
 	return nil
 }
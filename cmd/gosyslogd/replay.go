@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tomarus/gosyslogd/miner"
+	"github.com/tomarus/gosyslogd/packs"
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// tagReport counts the replay results of a single tag.
+type tagReport struct {
+	tag       string
+	total     int
+	unmatched int
+	rules     map[*parser.Logent]int
+}
+
+// replay implements the "replay" subcommand which feeds archive files, or
+// any other syslog file, through the parser and reports how each message
+// would have been classified. Nothing is published or stored.
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	rules := fs.String("rules", "", "Rules directory (default rules from config).")
+	out := fs.String("unmatched", "", "Write unmatched messages to this file.")
+	templates := fs.Bool("templates", false, "Print suggested rules for unmatched messages.")
+	rulePacks := fs.String("packs", "", "Comma separated rule packs to load (default rulepacks from config).")
+	from := fs.String("from", "", "Only replay messages from this time, a timestamp or a duration before now.")
+	to := fs.String("to", "", "Only replay messages until this time, a timestamp or a duration before now.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gosyslogd replay [options] file ...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := loadConfig(); err != nil && *rules == "" {
+		return err
+	}
+	if *rules == "" {
+		*rules = cfg.RulesDir
+	}
+	if *rulePacks != "" {
+		cfg.RulePacks = strings.Split(*rulePacks, ",")
+		if _, err := packs.Get(cfg.RulePacks...); err != nil {
+			return err
+		}
+	}
+
+	var tfrom, tto time.Time
+	var err error
+	now := time.Now()
+	if *from != "" {
+		if tfrom, err = parseWhen(*from, now); err != nil {
+			return err
+		}
+	}
+	if *to != "" {
+		if tto, err = parseWhen(*to, now); err != nil {
+			return err
+		}
+	}
+
+	p, err := parser.NewWithOptions(parserOptions(*rules))
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	var w io.Writer
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		bw := bufio.NewWriter(f)
+		defer bw.Flush()
+		w = bw
+	}
+
+	mi := miner.New(miner.Options{})
+	res, err := replayFiles(p, fs.Args(), tfrom, tto, mi, w)
+	if err != nil {
+		return err
+	}
+
+	printReport(os.Stdout, res.tags)
+	if *templates {
+		printTemplates(mi.Templates(""))
+	}
+	fmt.Printf("\n%d messages for tags without rules, %d unparsable lines.\n", res.unmonitored, res.skipped)
+	return nil
+}
+
+// replayResult holds the outcome of a replay.
+type replayResult struct {
+	tags        map[string]*tagReport
+	unmonitored int
+	skipped     int
+}
+
+// replayFiles feeds the messages of files between from and to through p.
+// Unmatched messages are added to mi and written to w if w is not nil.
+//
+// The files are read with syslogd.ParseLine rather than NewMessage, which
+// only accepts network packets: archive lines have no priority unless
+// "archivepri" is set, and their timestamps must be taken relative to the
+// day of the file instead of now.
+func replayFiles(p *parser.Parser, files []string, from, to time.Time, mi *miner.Miner, w io.Writer) (*replayResult, error) {
+	res := &replayResult{tags: make(map[string]*tagReport)}
+	for _, fn := range files {
+		ar, err := syslogd.OpenArchive(fn)
+		if err != nil {
+			return nil, err
+		}
+		if err := ar.Seek(from); err != nil {
+			ar.Close()
+			return nil, err
+		}
+		for {
+			m, err := ar.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				ar.Close()
+				return nil, err
+			}
+			if m.Time.Before(from) || (!to.IsZero() && m.Time.After(to)) {
+				continue
+			}
+
+			if !p.Selects(m) {
+				res.unmonitored++
+				continue
+			}
+			tr, x := res.tags[m.Tag]
+			if !x {
+				tr = &tagReport{tag: m.Tag, rules: make(map[*parser.Logent]int)}
+				res.tags[m.Tag] = tr
+			}
+			tr.total++
+			if logent, _, x := p.CheckMessage(m); x {
+				tr.rules[logent]++
+			} else {
+				tr.unmatched++
+				mi.Add(m)
+				if w != nil {
+					fmt.Fprintf(w, "%s\n", m.Raw)
+				}
+			}
+		}
+		res.skipped += ar.Skipped
+		ar.Close()
+	}
+	return res, nil
+}
+
+// printReport writes the number of matches per tag and rule to out.
+func printReport(out io.Writer, tags map[string]*tagReport) {
+	names := make([]string, 0, len(tags))
+	for t := range tags {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+
+	for _, t := range names {
+		tr := tags[t]
+		fmt.Fprintf(out, "%s: %d messages, %d matched, %d unmatched\n", tr.tag, tr.total, tr.total-tr.unmatched, tr.unmatched)
+
+		ents := make([]*parser.Logent, 0, len(tr.rules))
+		for e := range tr.rules {
+			ents = append(ents, e)
+		}
+		sort.Slice(ents, func(i, j int) bool {
+			if tr.rules[ents[i]] != tr.rules[ents[j]] {
+				return tr.rules[ents[i]] > tr.rules[ents[j]]
+			}
+			return ents[i].Regex() < ents[j].Regex()
+		})
+		for _, e := range ents {
+			fmt.Fprintf(out, "  %8d  %s  %s\n", tr.rules[e], e.Md5, e.Regex())
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomarus/gosyslogd/miner"
+	"github.com/tomarus/gosyslogd/parser"
+)
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rules := filepath.Join(dir, "rules")
+	os.Mkdir(rules, 0755)
+	ioutil.WriteFile(filepath.Join(rules, "sshd"), []byte("Failed password for\nAccepted publickey\n"), 0644)
+
+	fn := filepath.Join(dir, "web1.log")
+	ioutil.WriteFile(fn, []byte(strings.Join([]string{
+		"2016-03-12T10:00:00+01:00 web1 sshd[1]: Failed password for root from 10.0.0.1",
+		"2016-03-12T10:01:00+01:00 web1 sshd[2]: Failed password for bob from 10.0.0.2",
+		"2016-03-12T10:02:00+01:00 web1 sshd[3]: Accepted publickey for alice",
+		"2016-03-12T10:03:00+01:00 web1 sshd[4]: Connection closed by 10.0.0.3",
+		"2016-03-12T10:04:00+01:00 web1 cron[5]: job done",
+		"garbage",
+	}, "\n")+"\n"), 0644)
+
+	p, err := parser.NewWithOptions(parser.Options{Path: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	unmatched := new(bytes.Buffer)
+	res, err := replayFiles(p, []string{fn}, time.Time{}, time.Time{}, miner.New(miner.Options{}), unmatched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.unmonitored != 1 || res.skipped != 1 {
+		t.Errorf("Expected 1 unmonitored and 1 skipped line, got %d and %d", res.unmonitored, res.skipped)
+	}
+
+	out := new(bytes.Buffer)
+	printReport(out, res.tags)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || lines[0] != "sshd: 4 messages, 3 matched, 1 unmatched" {
+		t.Fatalf("Unexpected report:\n%s", out)
+	}
+	if !strings.HasPrefix(strings.TrimSpace(lines[1]), "2 ") || !strings.HasSuffix(lines[1], "Failed password for") {
+		t.Errorf("Expected the most matched rule first, got %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], "Accepted publickey") {
+		t.Errorf("Unexpected report line %q", lines[2])
+	}
+
+	if got := unmatched.String(); got != "2016-03-12T10:03:00+01:00 web1 sshd[4]: Connection closed by 10.0.0.3\n" {
+		t.Errorf("Unexpected unmatched output %q", got)
+	}
+}
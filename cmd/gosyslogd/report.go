@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tomarus/gosyslogd/parser"
+)
+
+// Report defaults, rules which did not match for a month and tags of which
+// less than half the messages match a rule.
+const (
+	defaultReportDays     = 30
+	defaultReportCoverage = 50
+)
+
+// ruleReport implements the "rule-report" subcommand which lists stale and
+// dead rules and tags with low coverage from the rule statistics file.
+func ruleReport(args []string) error {
+	fs := flag.NewFlagSet("rule-report", flag.ExitOnError)
+	file := fs.String("stats", "", "Rule statistics file (default rulestats from config).")
+	days := fs.Int("days", defaultReportDays, "Report rules which did not match for this many days.")
+	coverage := fs.Float64("coverage", defaultReportCoverage, "Report tags with less than this percentage of messages matched.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gosyslogd rule-report [options]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := loadConfig(); err != nil && *file == "" {
+		return err
+	}
+	if *file == "" {
+		*file = cfg.RuleStats
+	}
+	if *file == "" {
+		return errors.New("No rule statistics file configured.")
+	}
+
+	rules, tags, err := parser.ReadStats(*file)
+	if err != nil {
+		return err
+	}
+	r := parser.NewReport(rules, tags, time.Now(), time.Duration(*days)*24*time.Hour, *coverage)
+
+	fmt.Printf("Rules which did not match in %d days:\n", *days)
+	for _, s := range r.Stale {
+		fmt.Printf("  %s  %8d  %s  %s\n", s.Last.Format("2006-01-02"), s.Count, s.File, s.Regex)
+	}
+	fmt.Printf("\nRules which never matched:\n")
+	for _, s := range r.Dead {
+		fmt.Printf("  added %s  %s  %s\n", s.Added.Format("2006-01-02"), s.File, s.Regex)
+	}
+	fmt.Printf("\nTags with less than %g%% of messages matched:\n", *coverage)
+	for _, s := range r.LowCoverage {
+		fmt.Printf("  %5.1f%%  %8d  %s\n", s.Coverage(), s.Messages, s.Tag)
+	}
+	return nil
+}
+
+// httpRuleReport serves the report of the running parser as JSON. The
+// days and coverage parameters override the defaults.
+func httpRuleReport(w http.ResponseWriter, r *http.Request) {
+	days, coverage := float64(defaultReportDays), float64(defaultReportCoverage)
+	if v := r.FormValue("days"); v != "" {
+		var err error
+		if days, err = strconv.ParseFloat(v, 64); err != nil {
+			http.Error(w, "Invalid days.", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("coverage"); v != "" {
+		var err error
+		if coverage, err = strconv.ParseFloat(v, 64); err != nil {
+			http.Error(w, "Invalid coverage.", http.StatusBadRequest)
+			return
+		}
+	}
+	age := time.Duration(days * float64(24*time.Hour))
+	writeJSON(w, parse.Report(age, coverage))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+)
+
+// publishRuleStats exposes the rule statistics as expvar "rule_stats" and
+// on /rules/stats, and the report of stale and dead rules on /rules/report.
+// The stats endpoint orders rules by file, or by match count with
+// ?sort=count.
+func publishRuleStats() {
+	expvar.Publish("rule_stats", expvar.Func(func() interface{} {
+		return parse.Stats()
+	}))
+	expvar.Publish("tag_stats", expvar.Func(func() interface{} {
+		return parse.TagStats()
+	}))
+	http.HandleFunc("/rules/stats", httpRuleStats)
+	http.HandleFunc("/rules/report", httpRuleReport)
+}
+
+func httpRuleStats(w http.ResponseWriter, r *http.Request) {
+	stats := parse.Stats()
+	if r.FormValue("sort") == "count" {
+		sort.SliceStable(stats, func(i, j int) bool { return stats[i].Count > stats[j].Count })
+	}
+	writeJSON(w, stats)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
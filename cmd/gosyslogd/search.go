@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// query holds the filters of an archive search.
+type query struct {
+	from, to time.Time
+	host     string
+	tag      string
+	pri      *priFilter
+	rex      *regexp.Regexp
+}
+
+// match is a single line found by a search.
+type match struct {
+	m    *syslogd.Message
+	file int
+}
+
+// search implements the "search" subcommand which scans the archive in
+// LogDir for messages matching a time range, host, tag, priority and regex.
+func search(args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	from := fs.String("from", "", "Start of the time range, a timestamp or a duration before now like 2h (default today 00:00).")
+	to := fs.String("to", "", "End of the time range, a timestamp or a duration before now (default now).")
+	host := fs.String("host", "", "Only search hosts matching this glob pattern.")
+	tag := fs.String("tag", "", "Only search tags matching this glob pattern.")
+	pri := fs.String("pri", "", "Only search priorities matching this selector, e.g. auth.*, *.err or auth.warning.")
+	dir := fs.String("dir", "", "Archive directory (default logdir from config).")
+	workers := fs.Int("j", runtime.NumCPU(), "Number of files to scan in parallel.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gosyslogd search [options] [regex]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := loadConfig(); err != nil && *dir == "" {
+		return err
+	}
+	if *dir == "" {
+		*dir = cfg.LogDir
+	}
+	if *dir == "" {
+		return errors.New("No archive directory configured.")
+	}
+
+	var q query
+	var err error
+	now := time.Now()
+	q.from = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	q.to = now
+	if *from != "" {
+		if q.from, err = parseWhen(*from, now); err != nil {
+			return err
+		}
+	}
+	if *to != "" {
+		if q.to, err = parseWhen(*to, now); err != nil {
+			return err
+		}
+	}
+	q.host = *host
+	q.tag = *tag
+	if *pri != "" {
+		if q.pri, err = newPriFilter(*pri); err != nil {
+			return err
+		}
+	}
+	if fs.NArg() > 0 {
+		if q.rex, err = regexp.Compile(fs.Arg(0)); err != nil {
+			return err
+		}
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+
+	// Archive directories are per day, skip all days outside of the range.
+	first := time.Date(q.from.Year(), q.from.Month(), q.from.Day(), 0, 0, 0, 0, time.Local)
+	for day := first; !day.After(q.to); day = day.AddDate(0, 0, 1) {
+		files, err := syslogd.ArchiveFiles(*dir, day)
+		if err != nil {
+			return err
+		}
+		var selected []string
+		for _, fn := range files {
+			if q.host != "" {
+				if ok, _ := path.Match(q.host, syslogd.ArchiveHost(fn)); !ok {
+					continue
+				}
+			}
+			selected = append(selected, fn)
+		}
+		q.stream(selected, *workers, func(m match) {
+			fmt.Printf("%s\n", m.m.Raw)
+		})
+	}
+	return nil
+}
+
+// parseWhen parses a timestamp in one of a few common layouts, or a duration
+// which is subtracted from now.
+func parseWhen(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	layouts := []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"}
+	for _, l := range layouts {
+		if t, err := time.ParseInLocation(l, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Can't parse time %q", s)
+}
+
+// searchBatch is the number of matches a file is scanned ahead by.
+const searchBatch = 256
+
+// stream scans files in parallel and calls fn with every match, merged
+// by time. Archive files are written in the order messages arrive, so the
+// matches of each file are taken to be in time order already. Matches
+// with equal times are ordered by file. At most workers files are read at
+// the same time, each file is read ahead by at most two batches.
+func (q *query) stream(files []string, workers int, fn func(match)) {
+	sem := make(chan bool, workers)
+	feeds := make([]chan []match, len(files))
+	for i, f := range files {
+		feeds[i] = make(chan []match, 1)
+		go q.scanFile(f, i, sem, feeds[i])
+	}
+
+	heads := make([][]match, len(files))
+	for i := range feeds {
+		heads[i] = <-feeds[i]
+	}
+	for {
+		n := -1
+		for i, h := range heads {
+			if len(h) > 0 && (n < 0 || h[0].m.Time.Before(heads[n][0].m.Time)) {
+				n = i
+			}
+		}
+		if n < 0 {
+			return
+		}
+		fn(heads[n][0])
+		heads[n] = heads[n][1:]
+		if len(heads[n]) == 0 {
+			heads[n] = <-feeds[n]
+		}
+	}
+}
+
+// scanFile sends the matches of file fn in batches to out, and closes out
+// at the end of the file. It holds a slot of sem while reading.
+func (q *query) scanFile(fn string, n int, sem chan bool, out chan<- []match) {
+	defer close(out)
+	var ar *syslogd.ArchiveReader
+	for {
+		sem <- true
+		if ar == nil {
+			var err error
+			if ar, err = q.open(fn); err != nil {
+				<-sem
+				fmt.Fprintf(os.Stderr, "%s: %v\n", fn, err)
+				return
+			}
+			defer ar.Close()
+		}
+		var batch []match
+		var err error
+		for len(batch) < searchBatch {
+			var m *syslogd.Message
+			if m, err = ar.Next(); err != nil {
+				break
+			}
+			if q.matches(m) {
+				batch = append(batch, match{m: m, file: n})
+			}
+		}
+		<-sem
+
+		if len(batch) > 0 {
+			out <- batch
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", fn, err)
+			return
+		}
+	}
+}
+
+// open opens an archive file positioned at the start of the time range.
+func (q *query) open(fn string) (*syslogd.ArchiveReader, error) {
+	ar, err := syslogd.OpenArchive(fn)
+	if err != nil {
+		return nil, err
+	}
+	if err := ar.Seek(q.from); err != nil {
+		ar.Close()
+		return nil, err
+	}
+	return ar, nil
+}
+
+func (q *query) matches(m *syslogd.Message) bool {
+	if m.Time.Before(q.from) || m.Time.After(q.to) {
+		return false
+	}
+	if q.host != "" {
+		if ok, _ := path.Match(q.host, m.Hostname); !ok {
+			return false
+		}
+	}
+	if q.tag != "" {
+		if ok, _ := path.Match(q.tag, m.Tag); !ok {
+			return false
+		}
+	}
+	if q.pri != nil && !q.pri.matches(m) {
+		return false
+	}
+	if q.rex != nil && !q.rex.Match(m.Raw) {
+		return false
+	}
+	return true
+}
+
+// priFilter selects messages by a syslog.conf style selector "facility.severity",
+// which matches the severity or anything more severe. Either part may be "*".
+// A selector without a dot is a facility, or a severity if it is a known severity.
+type priFilter struct {
+	facility string
+	severity int
+}
+
+func newPriFilter(s string) (*priFilter, error) {
+	pf := &priFilter{facility: "*", severity: len(syslogd.Severities) - 1}
+	sev := ""
+	if n := strings.Index(s, "."); n >= 0 {
+		pf.facility = s[:n]
+		sev = s[n+1:]
+	} else if syslogd.ParseSeverity(s) >= 0 {
+		sev = s
+	} else {
+		pf.facility = s
+	}
+	if pf.facility != "*" && syslogd.ParseFacility(pf.facility) < 0 {
+		return nil, fmt.Errorf("Unknown facility %q", pf.facility)
+	}
+	if sev != "" && sev != "*" {
+		pf.severity = syslogd.ParseSeverity(sev)
+		if pf.severity < 0 {
+			return nil, fmt.Errorf("Unknown severity %q", sev)
+		}
+	}
+	return pf, nil
+}
+
+// matches never matches messages without a priority.
+func (pf *priFilter) matches(m *syslogd.Message) bool {
+	if m.Priority == syslogd.NoPriority {
+		return false
+	}
+	if pf.facility != "*" && pf.facility != m.Facility() {
+		return false
+	}
+	return int(m.Priority&7) <= pf.severity
+}
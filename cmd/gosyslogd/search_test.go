@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+func TestPriFilter(t *testing.T) {
+	authWarning := syslog.LOG_AUTH | syslog.LOG_WARNING
+	tests := []struct {
+		sel     string
+		pri     syslog.Priority
+		matches bool
+	}{
+		{"auth.*", authWarning, true},
+		{"auth.*", syslog.LOG_MAIL | syslog.LOG_WARNING, false},
+		{"*.err", authWarning, false},
+		{"*.err", syslog.LOG_MAIL | syslog.LOG_CRIT, true},
+		{"auth.warning", authWarning, true},
+		{"auth.warning", syslog.LOG_AUTH | syslog.LOG_NOTICE, false},
+		{"auth", syslog.LOG_AUTH | syslog.LOG_DEBUG, true},
+		{"err", syslog.LOG_LOCAL3 | syslog.LOG_ERR, true},
+		{"err", syslog.LOG_LOCAL3 | syslog.LOG_INFO, false},
+		{"*", syslogd.NoPriority, false},
+	}
+	for _, tt := range tests {
+		pf, err := newPriFilter(tt.sel)
+		if err != nil {
+			t.Errorf("%s: %v", tt.sel, err)
+			continue
+		}
+		m := &syslogd.Message{Priority: tt.pri}
+		if pf.matches(m) != tt.matches {
+			t.Errorf("%s: expected %v for %s", tt.sel, tt.matches, m.PriorityString())
+		}
+	}
+
+	for _, sel := range []string{"foo", "foo.err", "auth.foo", "unknown.*", ".err"} {
+		if _, err := newPriFilter(sel); err == nil {
+			t.Errorf("%s: expected an error", sel)
+		}
+	}
+}
+
+func TestParseWhen(t *testing.T) {
+	now := time.Date(2016, 3, 12, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		s    string
+		want time.Time
+	}{
+		{"2h", now.Add(-2 * time.Hour)},
+		{"2016-03-11", time.Date(2016, 3, 11, 0, 0, 0, 0, time.Local)},
+		{"2016-03-11 10:30", time.Date(2016, 3, 11, 10, 30, 0, 0, time.Local)},
+		{"2016-03-11T10:30", time.Date(2016, 3, 11, 10, 30, 0, 0, time.Local)},
+		{"2016-03-11 10:30:15", time.Date(2016, 3, 11, 10, 30, 15, 0, time.Local)},
+		{"2016-03-11T10:30:15Z", time.Date(2016, 3, 11, 10, 30, 15, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseWhen(tt.s, now)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseWhen(%q) = %v %v, expected %v", tt.s, got, err, tt.want)
+		}
+	}
+	if _, err := parseWhen("yesterday", now); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t0 := time.Date(2016, 3, 12, 10, 0, 0, 0, time.FixedZone("CET", 3600))
+	write := func(host string, lines ...string) string {
+		fn := filepath.Join(dir, host+".log")
+		f, err := os.Create(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		for i, l := range lines {
+			ts := t0.Add(time.Duration(i) * time.Minute).Format(time.RFC3339)
+			fmt.Fprintf(f, "<%s>%s %s\n", l[:2], ts, l[3:])
+		}
+		return fn
+	}
+	files := []string{
+		write("web1", "38 web1 sshd[1]: Failed password", "30 web1 cron[2]: job done", "35 web1 sshd[3]: Accepted key"),
+		write("db1", "35 db1 sshd[4]: Failed password", "27 db1 postgres[5]: error"),
+	}
+
+	tests := []struct {
+		q    query
+		want []string
+	}{
+		{query{}, []string{"web1 sshd[1]", "db1 sshd[4]", "web1 cron[2]", "db1 postgres[5]", "web1 sshd[3]"}},
+		{query{tag: "sshd"}, []string{"web1 sshd[1]", "db1 sshd[4]", "web1 sshd[3]"}},
+		{query{host: "db*"}, []string{"db1 sshd[4]", "db1 postgres[5]"}},
+		{query{rex: regexp.MustCompile("Failed")}, []string{"web1 sshd[1]", "db1 sshd[4]"}},
+		{query{from: t0.Add(time.Minute), to: t0.Add(time.Minute)}, []string{"web1 cron[2]", "db1 postgres[5]"}},
+	}
+	for i, tt := range tests {
+		q := tt.q
+		if q.to.IsZero() {
+			q.to = t0.Add(time.Hour)
+		}
+		if q.pri == nil {
+			q.pri, _ = newPriFilter("*")
+		}
+		var got []string
+		q.stream(files, 2, func(m match) {
+			got = append(got, fmt.Sprintf("%s %s[%d]", m.m.Hostname, m.m.Tag, m.m.Pid))
+		})
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%d: expected %v, got %v", i, tt.want, got)
+		}
+	}
+
+	q := query{to: t0.Add(time.Hour)}
+	q.pri, _ = newPriFilter("auth.warning")
+	var res []match
+	q.stream(files, 1, func(m match) { res = append(res, m) })
+	if len(res) != 2 || res[0].m.Pid != 4 || res[1].m.Pid != 3 {
+		t.Errorf("Expected the two auth messages of warning or worse, got %d matches", len(res))
+	}
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"expvar"
+
+	"github.com/tomarus/gosyslogd/anomaly"
 )
 
 type sysstats struct {
 	tags, hosts, priority *expvar.Map
+	reloads               *expvar.Map
+	reloadError           *expvar.String
 }
 
 func newStats() *sysstats {
@@ -13,9 +17,22 @@ func newStats() *sysstats {
 	s.tags = expvar.NewMap("tags")
 	s.hosts = expvar.NewMap("hosts")
 	s.priority = expvar.NewMap("pri")
+	s.reloads = expvar.NewMap("rule_reloads")
+	s.reloadError = expvar.NewString("rule_reload_error")
 	return s
 }
 
+// Reload counts rule reloads and keeps the error of the last failed one.
+func (s *sysstats) Reload(err error) {
+	if err != nil {
+		s.reloads.Add("failed", 1)
+		s.reloadError.Set(err.Error())
+		return
+	}
+	s.reloads.Add("ok", 1)
+	s.reloadError.Set("")
+}
+
 func (s *sysstats) Tag(tag string) {
 	s.tags.Add(tag, 1)
 }
@@ -27,3 +44,10 @@ func (s *sysstats) Host(host string) {
 func (s *sysstats) Priority(pri string) {
 	s.priority.Add(pri, 1)
 }
+
+// Anomalies exposes the ongoing rate anomalies as expvar "anomalies".
+func (s *sysstats) Anomalies(d *anomaly.Detector) {
+	expvar.Publish("anomalies", expvar.Func(func() interface{} {
+		return d.Active()
+	}))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/tomarus/gosyslogd/miner"
+)
+
+// httpTemplates serves the templates of unmatched messages, of all tags or
+// of the tag given by ?tag=. With ?format=rules they are written as rules
+// which can be pasted into the rule file of the tag, otherwise as JSON.
+func httpTemplates(w http.ResponseWriter, r *http.Request) {
+	ts := mine.Templates(r.FormValue("tag"))
+	if r.FormValue("format") == "rules" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeTemplates(w, ts)
+		return
+	}
+
+	type template struct {
+		miner.Template
+		Text  string
+		Regex string
+	}
+	out := make([]template, len(ts))
+	for i, t := range ts {
+		out[i] = template{t, t.String(), t.Regex()}
+	}
+	writeJSON(w, out)
+}
+
+// writeTemplates writes templates as rules, grouped by tag.
+func writeTemplates(w io.Writer, ts []miner.Template) {
+	byTag := make(map[string][]miner.Template)
+	var tags []string
+	for _, t := range ts {
+		if _, x := byTag[t.Tag]; !x {
+			tags = append(tags, t.Tag)
+		}
+		byTag[t.Tag] = append(byTag[t.Tag], t)
+	}
+	for _, tag := range tags {
+		fmt.Fprintf(w, "## %s\n", tag)
+		for _, t := range byTag[tag] {
+			fmt.Fprintf(w, "%s\n", t.Rule())
+		}
+	}
+}
+
+func printTemplates(ts []miner.Template) {
+	fmt.Printf("\nSuggested rules for unmatched messages:\n\n")
+	writeTemplates(os.Stdout, ts)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tomarus/gosyslogd/transaction"
+)
+
+// storeTransaction stores the lines of an ended transaction as a single
+// message, with the fields of the transaction and its outcome.
+func storeTransaction(tx *transaction.Transaction) {
+	if cfg.Postgres == "" {
+		return
+	}
+	lines := make([]string, len(tx.Messages))
+	for i, m := range tx.Messages {
+		lines[i] = string(m.Raw)
+	}
+	fields := map[string]string{"transaction": tx.ID, "host": tx.Hostname, "outcome": tx.Outcome}
+	for f, v := range tx.Fields {
+		fields[f] = v
+	}
+	psql.AddUnhandled(tx.Md5, strings.Join(lines, "\n"), fields)
+}
+
+// httpTransactions serves transactions as JSON, most recent first. The
+// parameters field, id, host, outcome, open and limit select transactions, see
+// transaction.Query. Other parameters select on extracted fields, e.g.
+// ?from=alice@example.com. The default limit is 100.
+func httpTransactions(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	q := transaction.Query{Limit: 100, Fields: make(map[string]string)}
+	for k := range r.Form {
+		v := r.Form.Get(k)
+		switch k {
+		case "field":
+			q.Field = v
+		case "id":
+			q.ID = v
+		case "host":
+			q.Hostname = v
+		case "outcome":
+			q.Outcome = v
+		case "open":
+			q.Open = v != "" && v != "0"
+		case "limit":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "Invalid limit.", http.StatusBadRequest)
+				return
+			}
+			q.Limit = n
+		default:
+			q.Fields[k] = v
+		}
+	}
+	writeJSON(w, trans.Find(q))
+}
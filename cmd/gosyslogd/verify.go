@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// verify checks the hash chain of each archive file and reports the first
+// tampered line. Returns false if any file failed verification.
+func verify(files []string) bool {
+	key, err := archiveKey()
+	if err != nil {
+		panic(err)
+	}
+
+	ok := true
+	for _, fn := range files {
+		v, err := syslogd.VerifyArchive(fn, key)
+		if err != nil {
+			fmt.Printf("%s: %v\n", fn, err)
+			ok = false
+			continue
+		}
+
+		if v.Tampered {
+			if v.FirstBad == v.LastBad {
+				fmt.Printf("%s: TAMPERED at line %d: %s\n", fn, v.FirstBad, v.Reason)
+			} else {
+				fmt.Printf("%s: TAMPERED between lines %d and %d: %s\n", fn, v.FirstBad, v.LastBad, v.Reason)
+			}
+			ok = false
+			continue
+		}
+
+		fmt.Printf("%s: OK, %d lines, %d checkpoints", fn, v.Lines, v.Checkpoints)
+		for _, r := range v.Unverified {
+			fmt.Printf(", lines %d-%d found after a restart are unverified", r[0], r[1])
+		}
+		if v.Trailing > 0 {
+			fmt.Printf(", %d trailing lines not covered by a checkpoint", v.Trailing)
+		}
+		fmt.Printf("\n")
+	}
+	return ok
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// workers processes messages concurrently. Messages are divided over the
+// workers by host or tag, so messages of one host or tag are processed in
+// the order they were received.
+type workers struct {
+	queues  []chan *syslogd.Message
+	shardBy string
+	wg      sync.WaitGroup
+}
+
+// newWorkers starts n workers which call fn for every message, at least one.
+// ShardBy is "host" or "tag", default "host".
+func newWorkers(n int, shardBy string, fn func(*syslogd.Message)) *workers {
+	if n < 1 {
+		n = 1
+	}
+	w := &workers{queues: make([]chan *syslogd.Message, n), shardBy: shardBy}
+	for i := range w.queues {
+		q := make(chan *syslogd.Message, 1024)
+		w.queues[i] = q
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for m := range q {
+				fn(m)
+			}
+		}()
+	}
+	return w
+}
+
+// add queues a message on the worker of its shard.
+func (w *workers) add(m *syslogd.Message) {
+	if len(w.queues) == 1 {
+		w.queues[0] <- m
+		return
+	}
+	key := m.Hostname
+	if w.shardBy == "tag" {
+		key = m.Tag
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	w.queues[h.Sum32()%uint32(len(w.queues))] <- m
+}
+
+// close waits until all queued messages are processed.
+func (w *workers) close() {
+	for _, q := range w.queues {
+		close(q)
+	}
+	w.wg.Wait()
+}
+
+// lockedConn serializes the use of a Redis connection by the workers.
+type lockedConn struct {
+	redis.Conn
+	mu sync.Mutex
+}
+
+func (c *lockedConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Do(cmd, args...)
+}
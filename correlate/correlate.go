@@ -0,0 +1,159 @@
+// Package correlate counts matches of rules with a threshold over sliding
+// windows and reports when a threshold is crossed.
+//
+// A rule with "threshold = 20/60s" fires when it matched 20 times within
+// 60 seconds. Matches are counted per group, configured with "groupby",
+// e.g. per host or per value of an extracted field. After firing a group
+// is suppressed until fewer than the threshold of matches remain in its
+// window, so an ongoing attack fires once and again after it stopped for
+// a while.
+package correlate
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// Groups which did not match for their window are removed every
+// gcInterval.
+const gcInterval = time.Minute
+
+// Event is reported when a threshold is crossed.
+type Event struct {
+	Rule string
+	Md5  string
+	// Group contains the values the matches were grouped by, by their
+	// groupby setting.
+	Group  map[string]string `json:",omitempty"`
+	Count  int
+	Window time.Duration
+	First  time.Time
+	Last   time.Time
+	// Message is the message which crossed the threshold.
+	Message *syslogd.Message
+}
+
+// Engine tracks the windows of all rules and groups. It is safe for
+// concurrent use.
+type Engine struct {
+	groups map[string]*group
+	lastGC time.Time
+	mu     sync.Mutex
+}
+
+// group holds the times of the last matches of a rule and group, at most
+// the threshold count.
+type group struct {
+	times  []time.Time
+	next   int
+	window time.Duration
+	fired  bool
+}
+
+// New creates an Engine.
+func New() *Engine {
+	return &Engine{groups: make(map[string]*group)}
+}
+
+// Add counts a match of rule e with message m at time t. It returns an
+// event if the threshold of the rule was crossed. Rules without threshold
+// are ignored.
+func (c *Engine) Add(e *parser.Logent, m *syslogd.Message, t time.Time) (*Event, bool) {
+	th := e.Threshold
+	if th == nil {
+		return nil, false
+	}
+	values := groupValues(th.GroupBy, m)
+	key := groupKey(e, th.GroupBy, values)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t.Sub(c.lastGC) >= gcInterval {
+		c.gc(t)
+		c.lastGC = t
+	}
+
+	g, x := c.groups[key]
+	if !x {
+		g = &group{times: make([]time.Time, 0, th.Count), window: th.Window}
+		c.groups[key] = g
+	}
+
+	// Keep the last Count match times, the oldest is at next once full.
+	if len(g.times) < th.Count {
+		g.times = append(g.times, t)
+	} else {
+		g.times[g.next] = t
+		g.next = (g.next + 1) % th.Count
+	}
+	if len(g.times) < th.Count {
+		return nil, false
+	}
+	oldest := g.times[g.next%len(g.times)]
+	crossed := t.Sub(oldest) <= th.Window
+
+	if !crossed {
+		g.fired = false
+		return nil, false
+	}
+	if g.fired {
+		return nil, false
+	}
+	g.fired = true
+	return &Event{
+		Rule:    e.ID,
+		Md5:     e.Md5,
+		Group:   values,
+		Count:   th.Count,
+		Window:  th.Window,
+		First:   oldest,
+		Last:    t,
+		Message: m,
+	}, true
+}
+
+// gc removes groups without matches within their window, which also ends
+// their suppression.
+func (c *Engine) gc(now time.Time) {
+	for k, g := range c.groups {
+		last := g.times[(g.next+len(g.times)-1)%len(g.times)]
+		if now.Sub(last) > g.window {
+			delete(c.groups, k)
+		}
+	}
+}
+
+// groupValues returns the values of a message for the groupby settings.
+func groupValues(groupBy []string, m *syslogd.Message) map[string]string {
+	if len(groupBy) == 0 {
+		return nil
+	}
+	values := make(map[string]string)
+	for _, g := range groupBy {
+		switch {
+		case g == "host":
+			values[g] = m.Hostname
+		case g == "tag":
+			values[g] = m.Tag
+		case strings.HasPrefix(g, "field:"):
+			values[g] = m.Fields[strings.TrimPrefix(g, "field:")]
+		}
+	}
+	return values
+}
+
+func groupKey(e *parser.Logent, groupBy []string, values map[string]string) string {
+	keys := append([]string(nil), groupBy...)
+	sort.Strings(keys)
+	k := e.Md5 + "\x00" + e.ID
+	for _, g := range keys {
+		k += "\x00" + values[g]
+	}
+	return k
+}
@@ -0,0 +1,51 @@
+package correlate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+func TestThreshold(t *testing.T) {
+	e := &parser.Logent{ID: "failed", Md5: "x", Threshold: &parser.Threshold{
+		Count:   3,
+		Window:  time.Minute,
+		GroupBy: []string{"field:ip"},
+	}}
+	c := New()
+	t0 := time.Date(2016, 3, 12, 10, 0, 0, 0, time.UTC)
+
+	add := func(ip string, sec int) bool {
+		m := &syslogd.Message{Fields: map[string]string{"ip": ip}}
+		_, fired := c.Add(e, m, t0.Add(time.Duration(sec)*time.Second))
+		return fired
+	}
+
+	// Two matches per window never fire.
+	for _, sec := range []int{0, 10, 80, 90} {
+		if add("10.0.0.1", sec) {
+			t.Fatalf("Unexpected event at %ds", sec)
+		}
+	}
+	// The third within a minute does, once.
+	if !add("10.0.0.1", 100) {
+		t.Fatal("Expected an event")
+	}
+	if add("10.0.0.1", 101) || add("10.0.0.1", 102) {
+		t.Fatal("Expected the group to be suppressed")
+	}
+	// Other groups are counted separately.
+	if add("10.0.0.2", 103) {
+		t.Fatal("Unexpected event of another group")
+	}
+
+	// After the rate dropped below the threshold it fires again.
+	if add("10.0.0.1", 200) || add("10.0.0.1", 201) {
+		t.Fatal("Unexpected event after reset")
+	}
+	if !add("10.0.0.1", 202) {
+		t.Fatal("Expected an event after reset")
+	}
+}
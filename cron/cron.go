@@ -0,0 +1,136 @@
+// Package cron parses cron schedules like "0 3 * * *".
+//
+// A schedule has five fields: minute, hour, day of month, month and day of
+// week (0-6, Sunday is 0 or 7). Fields are "*", a number, a range "1-5", a
+// step "*/15" or "1-30/2", or a comma separated list of those. Like cron,
+// if both day fields are restricted a time matches if either matches.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron schedule.
+type Schedule struct {
+	spec                     string
+	minute, hour, dom, month uint64
+	dow                      uint64
+	domAny, dowAny           bool
+}
+
+type field struct {
+	min, max int
+}
+
+var fields = []field{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// Parse parses a schedule.
+func Parse(spec string) (*Schedule, error) {
+	fs := strings.Fields(spec)
+	if len(fs) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, expected 5 fields", spec)
+	}
+	var bits [5]uint64
+	for i, f := range fs {
+		b, err := parseField(f, fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", spec, err)
+		}
+		bits[i] = b
+	}
+	s := &Schedule{
+		spec:   spec,
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: fs[2] == "*",
+		dowAny: fs[4] == "*",
+	}
+	// Sunday is both 0 and 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func parseField(s string, f field) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if n := strings.Index(part, "/"); n >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[n+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+			part = part[:n]
+		}
+		lo, hi := f.min, f.max
+		if part != "*" {
+			n := strings.Index(part, "-")
+			var err1, err2 error
+			if n >= 0 {
+				lo, err1 = strconv.Atoi(part[:n])
+				hi, err2 = strconv.Atoi(part[n+1:])
+			} else {
+				lo, err1 = strconv.Atoi(part)
+				hi = lo
+				if step > 1 {
+					hi = f.max
+				}
+			}
+			if err1 != nil || err2 != nil || lo < f.min || hi > f.max || lo > hi {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
+
+func (s *Schedule) matchDay(t time.Time) bool {
+	dom := has(s.dom, t.Day())
+	dow := has(s.dow, int(t.Weekday()))
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t which matches the schedule, in the
+// location of t. Returns a zero time if there is none within five years,
+// like for February 30.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case !has(s.month, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !has(s.hour, t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !has(s.minute, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
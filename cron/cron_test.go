@@ -0,0 +1,37 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	t0 := time.Date(2016, 3, 12, 10, 30, 15, 0, time.UTC) // Saturday
+	tests := []struct {
+		spec string
+		next string
+	}{
+		{"* * * * *", "2016-03-12 10:31"},
+		{"0 3 * * *", "2016-03-13 03:00"},
+		{"*/15 * * * *", "2016-03-12 10:45"},
+		{"0 9-17/4 * * 1-5", "2016-03-14 09:00"},
+		{"30 10 * * 0,6", "2016-03-13 10:30"},
+		{"0 0 1 * 7", "2016-03-13 00:00"},
+		{"0 0 29 2 *", "2020-02-29 00:00"},
+	}
+	for _, tc := range tests {
+		s, err := Parse(tc.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Next(t0).Format("2006-01-02 15:04"); got != tc.next {
+			t.Errorf("%s: expected %s, got %s", tc.spec, tc.next, got)
+		}
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
@@ -115,7 +115,7 @@ func New() *Cycbuf {
 	return c
 }
 
-func (cb *Cycbuf) AddString(str string, m *syslogd.Message) {
+func (cb *Cycbuf) sum(str string) string {
 	cb.sumlock.Lock()
 	defer cb.sumlock.Unlock()
 
@@ -126,6 +126,11 @@ func (cb *Cycbuf) AddString(str string, m *syslogd.Message) {
 		cb.sums[str] = fmt.Sprintf("%x", h.Sum(nil))
 		sum = cb.sums[str]
 	}
+	return sum
+}
+
+func (cb *Cycbuf) AddString(str string, m *syslogd.Message) {
+	sum := cb.sum(str)
 
 	cb.filelock.Lock()
 	defer cb.filelock.Unlock()
@@ -151,6 +156,19 @@ func (cb *Cycbuf) Add(sum string, m *syslogd.Message) {
 	cf.AddMsg(m)
 }
 
+// LastString returns the last "max" messages added with AddString for
+// "str", newest first.
+func (cb *Cycbuf) LastString(str string, max int) []*syslogd.Message {
+	sum := cb.sum(str)
+	cb.filelock.RLock()
+	cf, x := cb.files[sum]
+	cb.filelock.RUnlock()
+	if !x {
+		return nil
+	}
+	return cf.Last(max)
+}
+
 // Dump is called on program exit or signal.
 func (cb *Cycbuf) Dump() {
 }
@@ -0,0 +1,166 @@
+// Package dedup collapses repeats of a message into a summary, like the
+// "last message repeated N times" lines of syslogd.
+//
+// Messages are repeats when they have the same host, tag and normalised
+// text, which is the text after the tag with numbers and white space
+// normalised, so a changing pid, counter or port doesn't make a flapping
+// service look different every time. The first message of a window is
+// passed on, repeats within the window are suppressed and counted. When
+// the window ends a summary of the repeats is reported.
+package dedup
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// Options contain the configuration of a Deduper.
+type Options struct {
+	// OnSummary is called when a window with repeats ends.
+	OnSummary func(s Summary)
+}
+
+// Summary reports the repeats of a message in a window.
+type Summary struct {
+	// Rule is the rule the message matched, nil for unmatched messages.
+	Rule *parser.Logent
+	// Monitored is true if the message was checked against rules.
+	Monitored bool
+	// Count is the number of suppressed repeats. First is the time of the
+	// message which started the window, Last of the last repeat.
+	Count int
+	First time.Time
+	Last  time.Time
+	// Message is the last repeat.
+	Message *syslogd.Message
+}
+
+// Repeated returns a message for the summary, the last repeat with its
+// text replaced by "message repeated N times: [text]" and its fields
+// extended with the count in field "repeated".
+func (s Summary) Repeated() *syslogd.Message {
+	m := *s.Message
+	content := m.Content()
+	prefix := m.Raw[:len(m.Raw)-len(content)]
+	m.Raw = []byte(fmt.Sprintf("%smessage repeated %d times: [%s]", prefix, s.Count, content))
+	m.Fields = make(map[string]string, len(s.Message.Fields)+1)
+	for k, v := range s.Message.Fields {
+		m.Fields[k] = v
+	}
+	m.Fields["repeated"] = strconv.Itoa(s.Count)
+	return &m
+}
+
+type window struct {
+	start, end time.Time
+	summary    Summary
+}
+
+// Deduper tracks recent messages. It is safe for concurrent use.
+type Deduper struct {
+	opts    Options
+	windows map[string]*window
+	mu      sync.Mutex
+}
+
+// New creates a Deduper and starts reporting ended windows every second.
+func New(opts Options) *Deduper {
+	d := newDeduper(opts)
+	go func() {
+		for now := range time.Tick(time.Second) {
+			d.Flush(now)
+		}
+	}()
+	return d
+}
+
+func newDeduper(opts Options) *Deduper {
+	return &Deduper{opts: opts, windows: make(map[string]*window)}
+}
+
+// Add checks if m, matched by rule e or nil, at time t repeats a message
+// of the last length of window. Monitored tells if m was checked against
+// rules, it is reported in the summary. It returns true if m is a repeat
+// which should be suppressed.
+func (d *Deduper) Add(e *parser.Logent, m *syslogd.Message, monitored bool, length time.Duration, t time.Time) bool {
+	k := Key(e, m)
+
+	d.mu.Lock()
+	w, x := d.windows[k]
+	if x && t.Before(w.end) {
+		w.summary.Count++
+		w.summary.Last = t
+		w.summary.Message = m
+		d.mu.Unlock()
+		return true
+	}
+	d.windows[k] = &window{start: t, end: t.Add(length), summary: Summary{Rule: e, Monitored: monitored, First: t}}
+	d.mu.Unlock()
+
+	if x && w.summary.Count > 0 {
+		d.report(w.summary)
+	}
+	return false
+}
+
+// Flush reports and removes the windows which ended at now. It is called
+// every second.
+func (d *Deduper) Flush(now time.Time) {
+	var ended []Summary
+	d.mu.Lock()
+	for k, w := range d.windows {
+		if !now.Before(w.end) {
+			if w.summary.Count > 0 {
+				ended = append(ended, w.summary)
+			}
+			delete(d.windows, k)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, s := range ended {
+		d.report(s)
+	}
+}
+
+func (d *Deduper) report(s Summary) {
+	if d.opts.OnSummary != nil {
+		d.opts.OnSummary(s)
+	}
+}
+
+// Key returns the key of a message matched by rule e or nil, its rule,
+// host, tag and normalised text. Messages differing only in numbers can
+// match different rules, they are never repeats of each other.
+func Key(e *parser.Logent, m *syslogd.Message) string {
+	content := m.Content()
+	b := make([]byte, 0, len(m.Hostname)+len(m.Tag)+len(content)+3)
+	if e != nil {
+		b = append(b, e.Md5+e.ID...)
+	}
+	b = append(b, 0)
+	b = append(b, m.Hostname...)
+	b = append(b, 0)
+	b = append(b, m.Tag...)
+	b = append(b, 0)
+	var prev byte
+	for _, c := range content {
+		switch {
+		case c >= '0' && c <= '9':
+			c = '0'
+		case c == ' ' || c == '\t':
+			c = ' '
+		}
+		if (c == '0' || c == ' ') && c == prev {
+			continue
+		}
+		b = append(b, c)
+		prev = c
+	}
+	return string(b)
+}
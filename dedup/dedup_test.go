@@ -0,0 +1,93 @@
+package dedup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+func msg(host, text string) *syslogd.Message {
+	return &syslogd.Message{
+		Hostname: host,
+		Tag:      "nginx",
+		Raw:      []byte("Mar 12 10:00:00 " + host + " nginx[123]: " + text),
+		Fields:   map[string]string{"port": "80"},
+	}
+}
+
+func TestDeduper(t *testing.T) {
+	var summaries []Summary
+	d := newDeduper(Options{OnSummary: func(s Summary) { summaries = append(summaries, s) }})
+
+	t0 := time.Date(2016, 3, 12, 10, 0, 0, 0, time.UTC)
+	add := func(m *syslogd.Message, sec int) bool {
+		return d.Add(nil, m, m.Hostname != "db1", time.Minute, t0.Add(time.Duration(sec)*time.Second))
+	}
+
+	if add(msg("web1", "upstream 10.0.0.1:80 down"), 0) {
+		t.Fatal("Expected the first message to pass")
+	}
+	if !add(msg("web1", "upstream 10.0.0.1:8080   down"), 1) || !add(msg("web1", "upstream 10.0.0.2:80 down"), 2) {
+		t.Fatal("Expected messages differing in numbers and spaces to be repeats")
+	}
+	if add(msg("web2", "upstream 10.0.0.1:80 down"), 3) || add(msg("web1", "upstream 10.0.0.1:80 up"), 4) {
+		t.Fatal("Expected other hosts and texts not to be repeats")
+	}
+
+	d.Flush(t0.Add(59 * time.Second))
+	if len(summaries) != 0 {
+		t.Fatalf("Unexpected summaries before the window ended %+v", summaries)
+	}
+	d.Flush(t0.Add(time.Minute + 3*time.Second))
+	if len(summaries) != 1 || summaries[0].Count != 2 || !summaries[0].First.Equal(t0) || !summaries[0].Last.Equal(t0.Add(2*time.Second)) {
+		t.Fatalf("Expected a summary of 2 repeats, got %+v", summaries)
+	}
+	r := summaries[0].Repeated()
+	if string(r.Raw) != "Mar 12 10:00:00 web1 nginx[123]: message repeated 2 times: [upstream 10.0.0.2:80 down]" {
+		t.Errorf("Unexpected summary message %s", r.Raw)
+	}
+	if r.Fields["repeated"] != "2" || r.Fields["port"] != "80" || summaries[0].Message.Fields["repeated"] != "" {
+		t.Errorf("Unexpected summary fields %v", r.Fields)
+	}
+
+	// A repeat after the window starts a new one, reporting the previous.
+	summaries = nil
+	add(msg("web1", "upstream 10.0.0.1:80 up"), 10)
+	if add(msg("web1", "upstream 10.0.0.1:80 up"), 70) {
+		t.Error("Expected a message after the window to pass")
+	}
+	if len(summaries) != 1 || summaries[0].Count != 1 || !summaries[0].Monitored {
+		t.Errorf("Expected the previous window to be reported, got %+v", summaries)
+	}
+
+	// Windows remember if their messages were monitored.
+	summaries = nil
+	for _, host := range []string{"web1", "db1"} {
+		add(msg(host, "checkpoint starting"), 100)
+		add(msg(host, "checkpoint starting"), 101)
+	}
+	d.Flush(t0.Add(200 * time.Second))
+	if len(summaries) != 2 || summaries[0].Monitored == summaries[1].Monitored {
+		t.Errorf("Expected a monitored and an unmonitored summary, got %+v", summaries)
+	}
+}
+
+func TestDedupRules(t *testing.T) {
+	d := newDeduper(Options{})
+	t0 := time.Date(2016, 3, 12, 10, 0, 0, 0, time.UTC)
+	ok := &parser.Logent{ID: "ok", Md5: "1"}
+	failed := &parser.Logent{ID: "failed", Md5: "2"}
+
+	// Texts differing only in a digit which match different rules.
+	if d.Add(ok, msg("web1", "backup exited with status 0"), true, time.Minute, t0) {
+		t.Fatal("Expected the first message to pass")
+	}
+	if d.Add(failed, msg("web1", "backup exited with status 1"), true, time.Minute, t0.Add(time.Second)) {
+		t.Error("Expected a message of another rule not to be a repeat")
+	}
+	if !d.Add(failed, msg("web1", "backup exited with status 2"), true, time.Minute, t0.Add(2*time.Second)) {
+		t.Error("Expected a message of the same rule to be a repeat")
+	}
+}
@@ -0,0 +1,181 @@
+// Package expect raises alerts for rules which are expected to match on a
+// schedule but did not, a dead man's switch for messages like the success
+// line of a nightly backup. See parser.Expect for the rule settings.
+//
+// Rules are watched from the time the Watcher first sees them, so nothing
+// is reported for schedules before a start or reload.
+package expect
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// Options contain the configuration of a Watcher.
+type Options struct {
+	// Rules returns the current rules, usually Parser.Rules.
+	Rules func() []*parser.Logent
+	// OnMissed is called for every missed expected match.
+	OnMissed func(m Missed)
+	// Interval is the time between checks, default 1 minute.
+	Interval time.Duration
+}
+
+// Missed describes an expected match which did not arrive.
+type Missed struct {
+	Rule *parser.Logent `json:"-"`
+	ID   string
+	Md5  string
+	// Host is empty if a match of any host was expected.
+	Host     string `json:",omitempty"`
+	Expected string
+	// Due is when the match was expected at the latest.
+	Due time.Time
+	// Last is the time of the last match, zero if it never matched since
+	// the Watcher started.
+	Last time.Time
+}
+
+// Watcher tracks the matches of expected rules. It is safe for concurrent
+// use.
+type Watcher struct {
+	opts  Options
+	rules map[string]map[string]*target
+	mu    sync.Mutex
+}
+
+// target is a rule, or a rule and host, which is expected to match.
+type target struct {
+	since   time.Time // start of watching
+	last    time.Time // last match
+	due     time.Time // next scheduled time, for cron schedules
+	alerted bool      // missed interval reported, for intervals
+}
+
+// New creates a Watcher and starts checking.
+func New(opts Options) *Watcher {
+	if opts.Interval == 0 {
+		opts.Interval = time.Minute
+	}
+	w := &Watcher{opts: opts, rules: make(map[string]map[string]*target)}
+	go func() {
+		for now := range time.Tick(opts.Interval) {
+			w.Check(now)
+		}
+	}()
+	return w
+}
+
+func ruleKey(e *parser.Logent) string {
+	return e.Md5 + "\x00" + e.ID
+}
+
+// host returns the host a match of m counts for, and false if it does not
+// count at all.
+func host(x *parser.Expect, m *syslogd.Message) (string, bool) {
+	if len(x.Hosts) > 0 {
+		for _, h := range x.Hosts {
+			if h == m.Hostname {
+				return h, true
+			}
+		}
+		return "", false
+	}
+	if x.PerHost {
+		return m.Hostname, true
+	}
+	return "", true
+}
+
+func (w *Watcher) target(e *parser.Logent, host string, now time.Time) *target {
+	k := ruleKey(e)
+	hosts, x := w.rules[k]
+	if !x {
+		hosts = make(map[string]*target)
+		w.rules[k] = hosts
+	}
+	t, x := hosts[host]
+	if !x {
+		t = &target{since: now}
+		hosts[host] = t
+	}
+	return t
+}
+
+// Seen records a match of rule e with message m at time now.
+func (w *Watcher) Seen(e *parser.Logent, m *syslogd.Message, now time.Time) {
+	if e.Expect == nil {
+		return
+	}
+	h, ok := host(e.Expect, m)
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t := w.target(e, h, now)
+	t.last = now
+	t.alerted = false
+}
+
+// Check reports all expected matches which are overdue at now. It is
+// called periodically.
+func (w *Watcher) Check(now time.Time) {
+	var missed []Missed
+
+	w.mu.Lock()
+	for _, e := range w.opts.Rules() {
+		x := e.Expect
+		if x == nil {
+			continue
+		}
+		var hosts []string
+		switch {
+		case len(x.Hosts) > 0:
+			hosts = x.Hosts
+		case x.PerHost:
+			for h := range w.rules[ruleKey(e)] {
+				hosts = append(hosts, h)
+			}
+		default:
+			hosts = []string{""}
+		}
+
+		for _, h := range hosts {
+			t := w.target(e, h, now)
+			miss := Missed{Rule: e, ID: e.ID, Md5: e.Md5, Host: h, Expected: x.String(), Last: t.last}
+
+			if x.Schedule == nil {
+				ref := t.last
+				if ref.IsZero() {
+					ref = t.since
+				}
+				if now.Sub(ref) > x.Interval && !t.alerted {
+					t.alerted = true
+					miss.Due = ref.Add(x.Interval)
+					missed = append(missed, miss)
+				}
+				continue
+			}
+
+			if t.due.IsZero() {
+				t.due = x.Schedule.Next(t.since)
+			}
+			for !t.due.IsZero() && !now.Before(t.due.Add(x.Grace)) {
+				if t.last.Before(t.due) {
+					miss.Due = t.due.Add(x.Grace)
+					missed = append(missed, miss)
+				}
+				t.due = x.Schedule.Next(t.due)
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	for _, m := range missed {
+		w.opts.OnMissed(m)
+	}
+}
@@ -0,0 +1,57 @@
+package expect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tomarus/gosyslogd/cron"
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+func TestWatcher(t *testing.T) {
+	sched, err := cron.Parse("0 3 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := &parser.Logent{ID: "backup", Expect: &parser.Expect{Schedule: sched, Grace: time.Hour, Hosts: []string{"db1", "db2"}}}
+	heartbeat := &parser.Logent{ID: "heartbeat", Expect: &parser.Expect{Interval: 10 * time.Minute, PerHost: true}}
+
+	var missed []Missed
+	w := &Watcher{
+		opts: Options{
+			Rules:    func() []*parser.Logent { return []*parser.Logent{backup, heartbeat} },
+			OnMissed: func(m Missed) { missed = append(missed, m) },
+		},
+		rules: make(map[string]map[string]*target),
+	}
+	check := func(now time.Time) []Missed {
+		missed = nil
+		w.Check(now)
+		return missed
+	}
+	msg := func(host string) *syslogd.Message { return &syslogd.Message{Hostname: host} }
+
+	t0 := time.Date(2016, 3, 12, 12, 0, 0, 0, time.UTC)
+	w.Seen(heartbeat, msg("web1"), t0)
+	if m := check(t0); len(m) != 0 {
+		t.Fatalf("Unexpected missed %+v", m)
+	}
+
+	// Only db1 ran its backup at 03:00 the next day.
+	w.Seen(backup, msg("db1"), t0.Add(15*time.Hour+10*time.Minute))
+	w.Seen(backup, msg("db3"), t0.Add(15*time.Hour+10*time.Minute))
+	w.Seen(heartbeat, msg("web1"), t0.Add(15*time.Hour+55*time.Minute))
+	m := check(t0.Add(16*time.Hour + time.Minute))
+	if len(m) != 1 || m[0].ID != "backup" || m[0].Host != "db2" {
+		t.Fatalf("Expected the backup of db2 to be missed, got %+v", m)
+	}
+
+	// The heartbeat stops, it is reported once.
+	if m := check(t0.Add(16*time.Hour + 6*time.Minute)); len(m) != 1 || m[0].ID != "heartbeat" || m[0].Host != "web1" {
+		t.Fatalf("Expected the heartbeat of web1 to be missed, got %+v", m)
+	}
+	if m := check(t0.Add(16*time.Hour + 7*time.Minute)); len(m) != 0 {
+		t.Fatalf("Expected a missed heartbeat to be reported once, got %+v", m)
+	}
+}
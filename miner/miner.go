@@ -0,0 +1,261 @@
+// Package miner groups log messages into templates, to help writing rules
+// for messages which are not matched yet.
+//
+// Messages are clustered with the Drain algorithm: messages of a tag are
+// split into words and routed through a fixed depth tree by their number of
+// words and their first words, words containing digits are treated as
+// variable. Each leaf holds templates, a message joins the most similar
+// template if enough of its words are equal, the differing words become
+// variables. Otherwise it starts a new template.
+//
+// Example
+//
+//	m := miner.New(miner.Options{})
+//	m.Add(msg)
+//	for _, t := range m.Templates("sshd") {
+//		fmt.Println(t.Count, t.Regex())
+//	}
+package miner
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// Wildcard is the word used for variable parts of a template.
+const Wildcard = "<*>"
+
+// maxChildren limits the number of children of a tree node, further words
+// are routed to the wildcard child.
+const maxChildren = 100
+
+// Options contain the configuration of a Miner.
+type Options struct {
+	// Depth is the number of leading words used to route messages,
+	// default 3.
+	Depth int
+	// Similarity is the fraction of equal words for a message to join a
+	// template, default 0.5.
+	Similarity float64
+	// MaxTemplates limits the number of templates per tag, default 1000.
+	// Messages which don't fit an existing template are dropped after that.
+	MaxTemplates int
+	// MaxTags limits the number of tags, default 1000. Messages of further
+	// tags are dropped.
+	MaxTags int
+	// Examples is the number of example lines kept per template, default 3.
+	Examples int
+}
+
+// Template is a group of similar messages.
+type Template struct {
+	Tag string
+	// Words of the template, variable words are Wildcard.
+	Words    []string
+	Count    int64
+	Examples []string
+}
+
+// String returns the words of a template joined by spaces.
+func (t Template) String() string {
+	return strings.Join(t.Words, " ")
+}
+
+// Regex returns a regex matching the raw messages of the template, usable
+// as a rule. Variable words match any non space characters.
+func (t Template) Regex() string {
+	words := make([]string, len(t.Words))
+	for i, w := range t.Words {
+		if w == Wildcard {
+			words[i] = `\S+`
+		} else {
+			words[i] = regexp.QuoteMeta(w)
+		}
+	}
+	return ": " + strings.Join(words, `\s+`) + "$"
+}
+
+// Rule returns the template as a rule in the original rule file format,
+// with its examples as "#!example" lines, see the parser package.
+func (t Template) Rule() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %d messages: %s\n", t.Count, t)
+	for _, ex := range t.Examples {
+		fmt.Fprintf(&b, "#!example %s\n", ex)
+	}
+	b.WriteString(t.Regex() + "\n")
+	return b.String()
+}
+
+// Miner collects templates of messages per tag. It is safe for concurrent
+// use.
+type Miner struct {
+	opts Options
+	tags map[string]*tree
+	mu   sync.Mutex
+}
+
+type tree struct {
+	root      *node
+	templates int
+}
+
+type node struct {
+	children  map[string]*node
+	templates []*Template
+}
+
+func newNode() *node {
+	return &node{children: make(map[string]*node)}
+}
+
+// New creates a Miner.
+func New(opts Options) *Miner {
+	if opts.Depth == 0 {
+		opts.Depth = 3
+	}
+	if opts.Similarity == 0 {
+		opts.Similarity = 0.5
+	}
+	if opts.MaxTemplates == 0 {
+		opts.MaxTemplates = 1000
+	}
+	if opts.MaxTags == 0 {
+		opts.MaxTags = 1000
+	}
+	if opts.Examples == 0 {
+		opts.Examples = 3
+	}
+	return &Miner{opts: opts, tags: make(map[string]*tree)}
+}
+
+// Add adds a message to the templates of its tag.
+func (mi *Miner) Add(m *syslogd.Message) {
+	words := strings.Fields(string(m.Content()))
+
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+
+	tr, x := mi.tags[m.Tag]
+	if !x {
+		if len(mi.tags) >= mi.opts.MaxTags {
+			return
+		}
+		tr = &tree{root: newNode()}
+		mi.tags[m.Tag] = tr
+	}
+	leaf := mi.leaf(tr.root, words)
+
+	var best *Template
+	bestSim := -1.0
+	for _, t := range leaf.templates {
+		if sim := similarity(t.Words, words); sim > bestSim {
+			best, bestSim = t, sim
+		}
+	}
+	if best == nil || bestSim < mi.opts.Similarity {
+		if tr.templates >= mi.opts.MaxTemplates {
+			return
+		}
+		best = &Template{Tag: m.Tag, Words: words}
+		leaf.templates = append(leaf.templates, best)
+		tr.templates++
+	}
+
+	for i, w := range words {
+		if best.Words[i] != w {
+			best.Words[i] = Wildcard
+		}
+	}
+	best.Count++
+	if len(best.Examples) < mi.opts.Examples {
+		best.Examples = append(best.Examples, string(m.Raw))
+	}
+}
+
+// leaf returns the leaf node for a message, creating it if needed. The
+// first level is the number of words, the next levels the leading words.
+func (mi *Miner) leaf(n *node, words []string) *node {
+	key := []string{strconv.Itoa(len(words))}
+	for i := 0; i < mi.opts.Depth-1 && i < len(words); i++ {
+		key = append(key, routeWord(words[i]))
+	}
+	for _, k := range key {
+		c, x := n.children[k]
+		if !x {
+			if len(n.children) >= maxChildren {
+				k = Wildcard
+				c = n.children[k]
+			}
+			if c == nil {
+				c = newNode()
+				n.children[k] = c
+			}
+		}
+		n = c
+	}
+	return n
+}
+
+func routeWord(w string) string {
+	if strings.ContainsAny(w, "0123456789") {
+		return Wildcard
+	}
+	return w
+}
+
+// similarity returns the fraction of equal words, variable words of the
+// template are equal to any word. Words must be of equal length.
+func similarity(tmpl, words []string) float64 {
+	if len(words) == 0 {
+		return 1
+	}
+	same := 0
+	for i, w := range words {
+		if tmpl[i] == w || tmpl[i] == Wildcard {
+			same++
+		}
+	}
+	return float64(same) / float64(len(words))
+}
+
+// Templates returns the templates of a tag, or of all tags if tag is
+// empty, most frequent first.
+func (mi *Miner) Templates(tag string) []Template {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+
+	var ts []Template
+	for t, tr := range mi.tags {
+		if tag == "" || t == tag {
+			ts = collect(tr.root, ts)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		if ts[i].Count != ts[j].Count {
+			return ts[i].Count > ts[j].Count
+		}
+		return ts[i].String() < ts[j].String()
+	})
+	return ts
+}
+
+// collect appends copies of the templates below n.
+func collect(n *node, ts []Template) []Template {
+	for _, t := range n.templates {
+		c := *t
+		c.Words = append([]string(nil), t.Words...)
+		c.Examples = append([]string(nil), t.Examples...)
+		ts = append(ts, c)
+	}
+	for _, c := range n.children {
+		ts = collect(c, ts)
+	}
+	return ts
+}
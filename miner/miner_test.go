@@ -0,0 +1,54 @@
+package miner
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+func TestMiner(t *testing.T) {
+	mi := New(Options{MaxTags: 2})
+	add := func(tag, content string) {
+		line := "2016-03-12T10:00:00+01:00 web1 " + tag + "[42]: " + content
+		m, err := syslogd.ParseLine([]byte(line), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		mi.Add(m)
+	}
+	for i := 0; i < 10; i++ {
+		add("sshd", fmt.Sprintf("Connection closed by 10.0.0.%d port %d [preauth]", i, 40000+i))
+	}
+	add("sshd", "Connection closed by authenticating user root 10.0.0.1 port 22 [preauth]")
+	add("sshd", "Server listening on :: port 22.")
+	add("cron", "Connection closed by 10.0.0.1 port 1 [preauth]")
+	add("su", "Successful su for root by root")
+
+	ts := mi.Templates("sshd")
+	if len(ts) != 3 {
+		t.Fatalf("Expected 3 templates, got %d: %v", len(ts), ts)
+	}
+	if ts[0].Count != 10 || ts[0].String() != "Connection closed by <*> port <*> [preauth]" {
+		t.Errorf("Unexpected template %d %s", ts[0].Count, ts[0])
+	}
+	if len(ts[0].Examples) != 3 {
+		t.Errorf("Expected 3 examples, got %d", len(ts[0].Examples))
+	}
+
+	// The regex matches all raw messages of the template.
+	re := regexp.MustCompile(ts[0].Regex())
+	for _, ex := range ts[0].Examples {
+		if !re.MatchString(ex) {
+			t.Errorf("Regex %s does not match %s", re, ex)
+		}
+	}
+	if len(mi.Templates("")) != 4 {
+		t.Errorf("Expected 4 templates of all tags, got %d", len(mi.Templates("")))
+	}
+	if len(mi.Templates("su")) != 0 {
+		t.Error("Expected tags beyond MaxTags to be dropped")
+	}
+}
@@ -0,0 +1,53 @@
+// Package packs contains curated rule files for common daemons, which are
+// loaded alongside the local rules, see parser.Pack.
+//
+// Every pack is a directory in rules, laid out like a rules directory, with
+// a corpus of sample lines in corpus/<pack>.log. Each corpus line is the id
+// of the rule which must match, or "-" for lines no rule may match, a tab
+// and the line as written to an archive file. The tests check every pack
+// against its corpus.
+package packs
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"github.com/tomarus/gosyslogd/parser"
+)
+
+//go:embed rules
+var rules embed.FS
+
+// Names returns the names of all packs, sorted.
+func Names() []string {
+	dirs, _ := fs.ReadDir(rules, "rules")
+	var names []string
+	for _, d := range dirs {
+		if d.IsDir() {
+			names = append(names, d.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the named packs, all packs for "all".
+func Get(names ...string) ([]parser.Pack, error) {
+	var packs []parser.Pack
+	for _, name := range names {
+		if name == "all" {
+			return Get(Names()...)
+		}
+		sub, err := fs.Sub(rules, "rules/"+name)
+		if err == nil {
+			_, err = fs.Stat(sub, ".")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unknown rule pack %q", name)
+		}
+		packs = append(packs, parser.Pack{Name: name, FS: sub})
+	}
+	return packs, nil
+}
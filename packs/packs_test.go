@@ -0,0 +1,125 @@
+package packs
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+func TestLint(t *testing.T) {
+	packs, err := Get("all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packs) != 6 {
+		t.Errorf("Expected 6 packs, got %d", len(packs))
+	}
+	problems, err := parser.Lint(parser.Options{Path: t.TempDir(), Packs: packs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Error(p)
+	}
+	if _, err := Get("sshd", "apache"); err == nil {
+		t.Error("Expected an error for an unknown pack")
+	}
+}
+
+// TestCorpus checks the classification of the corpus of every pack, with
+// only that pack loaded.
+func TestCorpus(t *testing.T) {
+	ref := time.Date(2016, 3, 20, 0, 0, 0, 0, time.UTC)
+	for _, name := range Names() {
+		packs, _ := Get(name)
+		p, err := parser.NewWithOptions(parser.Options{Path: t.TempDir(), Packs: packs})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		f, err := os.Open("corpus/" + name + ".log")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		matched := make(map[string]bool)
+		s := bufio.NewScanner(f)
+		for n := 1; s.Scan(); n++ {
+			if s.Text() == "" || strings.HasPrefix(s.Text(), "#") {
+				continue
+			}
+			a := strings.SplitN(s.Text(), "\t", 2)
+			if len(a) != 2 {
+				t.Fatalf("%s.log:%d: expected a rule id, a tab and a line", name, n)
+			}
+			m, err := syslogd.ParseLine([]byte(a[1]), ref)
+			if err != nil {
+				t.Fatalf("%s.log:%d: %v", name, n, err)
+			}
+			e, _, x := p.CheckMessage(m)
+			switch {
+			case a[0] == "-" && x:
+				t.Errorf("%s.log:%d: expected no match, got %s", name, n, e.ID)
+			case a[0] != "-" && !x:
+				t.Errorf("%s.log:%d: expected %s, got no match", name, n, a[0])
+			case a[0] != "-" && e.ID != a[0]:
+				t.Errorf("%s.log:%d: expected %s, got %s", name, n, a[0], e.ID)
+			}
+			if x {
+				matched[e.ID] = true
+			}
+		}
+		f.Close()
+
+		// Every rule needs samples.
+		for _, e := range p.Rules() {
+			if !matched[e.ID] {
+				t.Errorf("%s: rule %s has no sample in the corpus", name, e.ID)
+			}
+		}
+		p.Close()
+	}
+}
+
+func TestOverride(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/sshd", []byte("#!v2\n[sshd-failed-password]\naction = ban\nmatch = : Failed password for \\S+ from (?P<ip>\\S+)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A file selecting the tags of several packs overrides rules of each.
+	if err := ioutil.WriteFile(dir+"/auth", []byte("#!v2\ntag = sudo, su\n[sudo-session]\naction = ignore\nmatch = : pam_unix\\(sudo:session\\)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	packs, _ := Get("sshd", "sudo")
+	p, err := parser.NewWithOptions(parser.Options{Path: dir, Packs: packs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	e, fields, x := p.Check("sshd", "Mar 12 10:00:00 web1 sshd[1]: Failed password for root from 203.0.113.5 port 22 ssh2")
+	if !x || e.Threshold != nil || e.Actions[0].Type != parser.ActionBan || fields["ip"] != "203.0.113.5" {
+		t.Errorf("Expected the local rule, got %+v", e)
+	}
+	e, _, _ = p.Check("sshd", "Mar 12 10:00:00 web1 sshd[1]: Failed publickey for root from 203.0.113.5 port 22 ssh2")
+	if e != nil {
+		t.Errorf("Expected the rule of the pack to be replaced, got %+v", e)
+	}
+
+	e, _, x = p.Check("sudo", "Mar 12 10:00:00 web1 sudo: pam_unix(sudo:session): session opened for user root(uid=0) by alice(uid=1000)")
+	if !x || e.Actions[0].Type != parser.ActionIgnore {
+		t.Errorf("Expected the local rule, got %+v", e)
+	}
+	e, _, _ = p.Check("sudo", "Mar 12 10:00:00 web1 sudo: pam_unix(sudo-i:session): session opened for user root(uid=0) by alice(uid=1000)")
+	if e != nil {
+		t.Errorf("Expected the rule of the pack to be replaced, got %+v", e)
+	}
+	e, _, x = p.Check("sudo", "Mar 12 10:00:00 web1 sudo: alice : 3 incorrect password attempts ; TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/usr/bin/id")
+	if !x || e.ID != "sudo-incorrect-password" {
+		t.Errorf("Expected other rules of the pack to stay, got %+v", e)
+	}
+}
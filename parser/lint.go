@@ -0,0 +1,219 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"regexp/syntax"
+	"strings"
+)
+
+// Problem is an issue found in a rule file by Lint.
+type Problem struct {
+	File string
+	// Line is the line of the rule in the file, 0 if the problem concerns
+	// the whole file.
+	Line int
+	// Rule is the id of a v2 rule or the regex of a rule in the original
+	// format, empty for file problems.
+	Rule    string
+	Message string
+	// Fatal is true for errors, which make the rules fail to load or their
+	// examples fail. Other problems are warnings.
+	Fatal bool
+}
+
+func (p Problem) String() string {
+	s := p.File
+	if p.Line > 0 {
+		s += fmt.Sprintf(":%d", p.Line)
+	}
+	if p.Rule != "" {
+		s += ": " + p.Rule
+	}
+	if !p.Fatal {
+		return s + ": warning: " + p.Message
+	}
+	return s + ": " + p.Message
+}
+
+// Lint checks all rule files of the rules directory and the packs in opts
+// without loading them into a Parser. Every file is compiled and checked
+// for:
+//
+//   - duplicate rules, only the first one is ever used
+//   - rules which can never match because an earlier rule in the same file
+//     matches everything they match
+//   - regexes which still start with "!" after the importance prefix, like
+//     "!!!x" or "match = !x" in v2 files, the "!" is matched literally
+//   - examples which their rule does not match or an earlier rule matches
+//     first, and counterexamples which their rule matches
+//
+// Examples are matched against the raw message as received, like rules.
+// The returned error is only set if the rules directory can't be read.
+func Lint(opts Options) ([]Problem, error) {
+	p := &Parser{path: opts.Path, opts: opts}
+	local := os.DirFS(p.path)
+	files, err := ruleFiles(local, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	tags := make(map[string]string)
+	for _, name := range files {
+		fn := p.path + "/" + name
+		ents, sel, err := readRules(local, name, fn)
+		if err == nil {
+			err = p.checkNames(sel, ents, fn)
+		}
+		if err != nil {
+			problems = append(problems, Problem{File: fn, Message: err.Error(), Fatal: true})
+			continue
+		}
+
+		if len(sel.tags) == 0 {
+			sel.tags = []string{name}
+		}
+		for i, t := range sel.tags {
+			sel.tags[i] = p.normalize(t)
+		}
+		if tag, x := sel.exactTag(); x {
+			if other, x := tags[tag]; x {
+				problems = append(problems, Problem{File: fn, Message: fmt.Sprintf("tag \"%s\" is also used by %s", tag, other), Fatal: true})
+			}
+			tags[tag] = fn
+		}
+
+		problems = append(problems, lintRules(fn, ents)...)
+	}
+
+	for _, pack := range opts.Packs {
+		files, err := ruleFiles(pack.FS, ".")
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range files {
+			fn := "packs/" + pack.Name + "/" + name
+			ents, _, err := readRules(pack.FS, name, fn)
+			if err != nil {
+				problems = append(problems, Problem{File: fn, Message: err.Error(), Fatal: true})
+				continue
+			}
+			problems = append(problems, lintRules(fn, ents)...)
+		}
+	}
+	return problems, nil
+}
+
+// lintRules checks the rules of a single file, in file order.
+func lintRules(fn string, ents []*Logent) []Problem {
+	var problems []Problem
+	add := func(e *Logent, fatal bool, format string, a ...interface{}) {
+		problems = append(problems, Problem{
+			File:    fn,
+			Line:    e.line,
+			Rule:    e.name(),
+			Message: fmt.Sprintf(format, a...),
+			Fatal:   fatal,
+		})
+	}
+
+	seen := make(map[string]*Logent)
+	for i, e := range ents {
+		if strings.HasPrefix(e.raw, "!") {
+			add(e, false, "regex starts with \"!\" after the importance prefix, which is matched literally")
+		}
+
+		if first, x := seen[e.raw]; x {
+			add(e, false, "duplicate of line %d", first.line)
+		} else if s := shadowedBy(e, ents[:i]); s != nil {
+			add(e, false, "unreachable, line %d matches everything it matches", s.line)
+		}
+		if _, x := seen[e.raw]; !x {
+			seen[e.raw] = e
+		}
+
+		for _, ex := range e.examples {
+			if !e.rex.MatchString(ex) {
+				add(e, true, "example does not match: %s", ex)
+				continue
+			}
+			for _, prev := range ents[:i] {
+				if prev.rex.MatchString(ex) {
+					add(e, true, "example is matched by line %d first: %s", prev.line, ex)
+					break
+				}
+			}
+		}
+		for _, ex := range e.counterexamples {
+			if e.rex.MatchString(ex) {
+				add(e, true, "counterexample matches: %s", ex)
+			}
+		}
+	}
+	return problems
+}
+
+// name returns the name of a rule used in messages.
+func (e *Logent) name() string {
+	if e.ID != e.Md5 {
+		return e.ID
+	}
+	return e.raw
+}
+
+// shadowedBy returns the first of the earlier rules which matches every
+// message e matches, or nil. Only simple cases are detected: rules which
+// match any message, and plain text rules whose text is part of the text
+// every match of e contains.
+func shadowedBy(e *Logent, earlier []*Logent) *Logent {
+	var lits []string
+	if re, err := syntax.Parse(e.raw, syntax.Perl); err == nil {
+		lits = requiredLiterals(re.Simplify())
+	}
+	for _, prev := range earlier {
+		re, err := syntax.Parse(prev.raw, syntax.Perl)
+		if err != nil {
+			continue
+		}
+		re = re.Simplify()
+		if matchesAll(re) {
+			return prev
+		}
+		if re.Op != syntax.OpLiteral || re.Flags&syntax.FoldCase != 0 {
+			continue
+		}
+		for _, l := range lits {
+			if strings.Contains(l, string(re.Rune)) {
+				return prev
+			}
+		}
+	}
+	return nil
+}
+
+// matchesAll returns true if an unanchored search for re matches any input.
+func matchesAll(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpStar, syntax.OpQuest:
+		return true
+	case syntax.OpRepeat:
+		return re.Min == 0
+	case syntax.OpCapture:
+		return matchesAll(re.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if !matchesAll(sub) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if matchesAll(sub) {
+				return true
+			}
+		}
+	}
+	return false
+}
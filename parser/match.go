@@ -0,0 +1,266 @@
+package parser
+
+import (
+	"math/bits"
+	"regexp/syntax"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// minPrefilter is the number of rules from which a rule file uses a
+// prefilter. Smaller files are matched rule by rule.
+const minPrefilter = 8
+
+// prefilter selects the rules of a rule file which can match a message.
+// Most regexes contain text which every match includes, like "Failed
+// password for" in "^Failed password for (\S+)". The longest of these
+// literals of every rule is searched for in one pass over the message with
+// an Aho-Corasick automaton, only rules whose literal was found, and rules
+// without a literal, are tried. Rules are still tried in file order, so
+// the first matching rule does not depend on the prefilter.
+type prefilter struct {
+	ac     *acMatcher
+	always []uint64 // rules without a literal
+	sets   sync.Pool
+}
+
+// newPrefilter returns a prefilter for a list of rules, or nil if the
+// rules are better matched one by one.
+func newPrefilter(ents []*Logent) *prefilter {
+	if len(ents) < minPrefilter {
+		return nil
+	}
+
+	words := (len(ents) + 63) / 64
+	pf := &prefilter{always: make([]uint64, words)}
+	pf.sets.New = func() interface{} {
+		s := make([]uint64, words)
+		return &s
+	}
+
+	lits := make([]string, len(ents))
+	found := 0
+	for i, e := range ents {
+		lits[i] = e.literal()
+		if lits[i] == "" {
+			pf.always[i/64] |= 1 << uint(i%64)
+		} else {
+			found++
+		}
+	}
+	if found == 0 {
+		return nil
+	}
+	pf.ac = newACMatcher(lits)
+	return pf
+}
+
+// candidates returns the set of rules which can match msg. The set must be
+// returned with release.
+func (pf *prefilter) candidates(msg string) *[]uint64 {
+	set := pf.sets.Get().(*[]uint64)
+	copy(*set, pf.always)
+	pf.ac.match(msg, func(id int) {
+		(*set)[id/64] |= 1 << uint(id%64)
+	})
+	return set
+}
+
+func (pf *prefilter) release(set *[]uint64) {
+	pf.sets.Put(set)
+}
+
+// literal returns the longest text every match of the rule contains, or an
+// empty string if there is none.
+func (e *Logent) literal() string {
+	re, err := syntax.Parse(e.raw, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	var lit string
+	for _, l := range requiredLiterals(re.Simplify()) {
+		// Invalid UTF-8 in a message matches U+FFFD in a regex, but not
+		// in a byte search.
+		if len(l) > len(lit) && !strings.ContainsRune(l, utf8.RuneError) {
+			lit = l
+		}
+	}
+	return lit
+}
+
+// requiredLiterals returns case sensitive strings which are contained in
+// every match of re. It is not exhaustive.
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase == 0 {
+			return []string{string(re.Rune)}
+		}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// Adjacent literals form a single longer literal.
+		var lits []string
+		var cur strings.Builder
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0 {
+				cur.WriteString(string(sub.Rune))
+				continue
+			}
+			if cur.Len() > 0 {
+				lits = append(lits, cur.String())
+				cur.Reset()
+			}
+			lits = append(lits, requiredLiterals(sub)...)
+		}
+		if cur.Len() > 0 {
+			lits = append(lits, cur.String())
+		}
+		return lits
+	}
+	return nil
+}
+
+// check returns the first rule of the file which matches msg.
+func (tp *tagParser) check(msg string) (*Logent, map[string]string, bool) {
+	if tp.pre == nil {
+		return tp.checkLinear(msg)
+	}
+
+	set := tp.pre.candidates(msg)
+	defer tp.pre.release(set)
+	for w, word := range *set {
+		for word != 0 {
+			b := bits.TrailingZeros64(word)
+			word &= word - 1
+			e := tp.entryarr[w*64+b]
+			if fields, x := e.match(msg); x {
+				return e, fields, true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// checkLinear tries all rules of the file in order.
+func (tp *tagParser) checkLinear(msg string) (*Logent, map[string]string, bool) {
+	for _, e := range tp.entryarr {
+		if fields, x := e.match(msg); x {
+			return e, fields, true
+		}
+	}
+	return nil, nil, false
+}
+
+// match matches a single rule and returns its named capture groups.
+func (e *Logent) match(msg string) (map[string]string, bool) {
+	if !e.fields {
+		if e.rex.MatchString(msg) {
+			e.matched(msg)
+			return nil, true
+		}
+		return nil, false
+	}
+	if sub := e.rex.FindStringSubmatch(msg); sub != nil {
+		e.matched(msg)
+		return e.extract(sub), true
+	}
+	return nil, false
+}
+
+func (e *Logent) matched(msg string) {
+	if e.stats != nil {
+		e.stats.record(msg, time.Now())
+	}
+}
+
+// acMatcher is an Aho-Corasick automaton which finds all occurrences of a
+// set of strings in a single pass.
+type acMatcher struct {
+	nodes []acNode
+}
+
+type acNode struct {
+	next map[byte]int
+	fail int
+	// out lists the ids of the strings ending here, including those
+	// reached through fail links.
+	out []int
+}
+
+// newACMatcher builds a matcher for patterns, the id of a pattern is its
+// index. Empty patterns are ignored.
+func newACMatcher(patterns []string) *acMatcher {
+	m := &acMatcher{nodes: []acNode{{next: make(map[byte]int)}}}
+	for id, p := range patterns {
+		if p == "" {
+			continue
+		}
+		n := 0
+		for i := 0; i < len(p); i++ {
+			c := p[i]
+			nx, x := m.nodes[n].next[c]
+			if !x {
+				nx = len(m.nodes)
+				m.nodes = append(m.nodes, acNode{next: make(map[byte]int)})
+				m.nodes[n].next[c] = nx
+			}
+			n = nx
+		}
+		m.nodes[n].out = append(m.nodes[n].out, id)
+	}
+
+	// Set the fail links breadth first, a fail link points to the node of
+	// the longest proper suffix which is also in the trie.
+	queue := make([]int, 0, len(m.nodes))
+	for _, nx := range m.nodes[0].next {
+		queue = append(queue, nx)
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for c, nx := range m.nodes[n].next {
+			f := m.nodes[n].fail
+			for f != 0 {
+				if _, x := m.nodes[f].next[c]; x {
+					break
+				}
+				f = m.nodes[f].fail
+			}
+			if ff, x := m.nodes[f].next[c]; x && ff != nx {
+				f = ff
+			}
+			m.nodes[nx].fail = f
+			m.nodes[nx].out = append(m.nodes[nx].out, m.nodes[f].out...)
+			queue = append(queue, nx)
+		}
+	}
+	return m
+}
+
+// match calls fn for every occurrence of a pattern in s.
+func (m *acMatcher) match(s string, fn func(id int)) {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		for {
+			if nx, x := m.nodes[n].next[c]; x {
+				n = nx
+				break
+			}
+			if n == 0 {
+				break
+			}
+			n = m.nodes[n].fail
+		}
+		for _, id := range m.nodes[n].out {
+			fn(id)
+		}
+	}
+}
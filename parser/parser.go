@@ -2,202 +2,586 @@ package parser
 
 import (
 	"bufio"
-	"crypto/md5"
 	"fmt"
-	"io"
-	"io/ioutil"
+	"io/fs"
 	"os"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/tomarus/gosyslogd/syslogd"
 )
 
 // Parser handles parsing of regexps to raw syslog messages.
+// A Parser is safe for concurrent use, also while it reloads its rules.
 type Parser struct {
-	tagmap map[string]*tagParser
+	path  string
+	opts  Options
+	rules atomic.Value
+
+	stats   map[statsKey]*ruleStats
+	statsMu sync.Mutex
+	tags    sync.Map // normalised tag to *tagCounter
+
+	// quit is closed by Close to stop the background goroutines.
+	quit      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
-type tagParser struct {
-	entrymap  map[string]*Logent
-	entryarr  logEntries
-	totchecks int64
-	Tag       string
-	filename  string
-	lastmod   time.Time
+// ruleset contains all rule files of the rules directory. Files which
+// apply to a single tag are stored by tag, all others in a list ordered by
+// file name. Files of rule packs are kept apart, in the order of the packs.
+// A ruleset is not modified after loading, reloads replace it.
+type ruleset struct {
+	tagmap   map[string]*tagParser
+	selected []*tagParser
+	packs    []*tagParser
+}
+
+// Options contain the configuration of a Parser.
+type Options struct {
+	// Path is the directory containing the rule files.
+	Path string
+
+	// HostGroups maps host group names, used by the "hostgroup" setting of
+	// rule files, to lists of host glob patterns.
+	HostGroups map[string][]string
+
+	// Commands lists the names of the commands exec actions may run.
+	Commands []string
+
+	// Normalize lists the normalisations applied to tags of both messages
+	// and rule files before they are compared:
+	//
+	//	lower  compare tags case insensitive
+	//	trim   strip surrounding white space and a trailing colon
+	//	path   use the base name of tags which are absolute paths,
+	//	       like "/usr/sbin/cron"
+	Normalize []string
+
+	// OnReload, if set, is called after the rules directory was reloaded
+	// because it changed. Err is nil on success. On error the previously
+	// loaded rules stay in use.
+	OnReload func(err error)
+
+	// StatsFile, if set, is the file the statistics of the rules are saved
+	// to periodically, and read from on start, see Stats.
+	StatsFile string
+
+	// Packs are loaded after the rules directory, see Pack.
+	Packs []Pack
+}
+
+// Pack is a set of rule files, like the packs of the packs package, which
+// is loaded alongside the rules directory. Local rules take precedence:
+// rules of the rules directory are tried before the rules of packs, and a
+// rule of a pack is left out if the local file of its tag has a rule with
+// the same id.
+type Pack struct {
+	Name string
+	// FS contains the rule files, laid out like the rules directory.
+	FS fs.FS
 }
 
-type logEntries []*Logent
+type tagParser struct {
+	entrymap map[string]*Logent
+	entryarr []*Logent
+	pre      *prefilter
+	Tag      string
+	filename string
+	sel      *selector
+}
 
 // Logent defines a single unique log entry. A unique Logent is defined as
 // a tag, a hostname, a priority name or a regexp.
 type Logent struct {
-	rex   *regexp.Regexp
-	raw   string
-	count int64
-
-	Md5       string
+	rex    *regexp.Regexp
+	raw    string
+	stats  *ruleStats
+	fields bool
+
+	// Position in the rule file and embedded test cases.
+	line            int
+	examples        []string
+	counterexamples []string
+
+	Md5 string
+	// Important is the level of the rule, 0 normal, 1 important, 2 critical.
 	Important int
+
+	// Rule metadata, only set for rules in the v2 format. ID defaults
+	// to Md5 for rules in the original format.
+	ID          string
+	Description string
+	Owner       string
+	Runbook     string
+
+	// Actions lists what to do on a match.
+	Actions []Action
+
+	// Threshold, if set, delays the actions until the rule matched often
+	// enough.
+	Threshold *Threshold
+
+	// Transaction, if set, groups the matches of the rule into
+	// transactions.
+	Transaction *Transaction
+
+	// Expect, if set, alerts when the rule does not match in time.
+	Expect *Expect
+
+	// Dedup, if set, is the window in which repeats of a matched message
+	// are collapsed, 0 disables deduplication for the rule.
+	Dedup *time.Duration
+}
+
+// Regex returns the regular expression of a Logent.
+func (e *Logent) Regex() string {
+	return e.raw
 }
 
 // New reads the directory structure pointed to by path for match lists.
 // The name of the file must be the same as the matched syslog tag, eg "cron", "sshd", etc.
 // Each list contains a list of regexes.
+//
+// Tags containing a slash are stored in subdirectories, the file
+// "postfix/smtpd" holds the rules of tag "postfix/smtpd". Alternatively
+// a file can declare its tag with a "tag" setting in the v2 format, or a
+// "#!tag postfix/smtpd" line in the original format. Files starting with
+// a dot are skipped.
 func New(path string) (*Parser, error) {
-	files, err := ioutil.ReadDir(path)
+	return NewWithOptions(Options{Path: path})
+}
+
+// NewWithOptions creates a Parser like New using the given options.
+func NewWithOptions(opts Options) (*Parser, error) {
+	p := &Parser{path: opts.Path, opts: opts, quit: make(chan struct{})}
+	for _, n := range opts.Normalize {
+		if n != "lower" && n != "trim" && n != "path" {
+			return nil, fmt.Errorf("Unknown tag normalisation %q", n)
+		}
+	}
+
+	if opts.StatsFile != "" {
+		if err := p.loadStats(); err != nil {
+			return nil, err
+		}
+	}
+
+	rs, err := p.load()
 	if err != nil {
 		return nil, err
 	}
+	p.rules.Store(rs)
 
-	p := new(Parser)
-	p.tagmap = make(map[string]*tagParser)
+	// Start watching before returning so no change is missed.
+	changed := make(chan bool, 1)
+	if err := p.watch(changed); err != nil {
+		fmt.Printf("Can't watch %s, polling for changes: %v\n", p.path, err)
+		p.goRun(func() { p.poll(changed, p.snapshot()) })
+	}
+	p.goRun(func() { p.reloader(changed) })
+	if opts.StatsFile != "" {
+		p.goRun(p.statsSaver)
+	}
+	return p, nil
+}
 
-	for _, file := range files {
-		tp, err := p.newTagParser(path + "/" + file.Name())
+// goRun runs fn in a goroutine which Close waits for.
+func (p *Parser) goRun(fn func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		fn()
+	}()
+}
+
+// Close stops watching the rules directory and reloading rules, and waits
+// for a reload in progress to finish. Statistics are not saved, see
+// SaveStats. The loaded rules can still be used to check messages.
+func (p *Parser) Close() {
+	p.closeOnce.Do(func() { close(p.quit) })
+	p.wg.Wait()
+}
+
+// load reads and compiles all rule files.
+func (p *Parser) load() (*ruleset, error) {
+	local := os.DirFS(p.path)
+	files, err := ruleFiles(local, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &ruleset{tagmap: make(map[string]*tagParser)}
+	for _, name := range files {
+		tp, err := p.newTagParser(local, name, p.path+"/"+name)
 		if err != nil {
 			return nil, err
 		}
-		tp.Tag = file.Name()
-		p.tagmap[tp.Tag] = tp
-		fmt.Printf("Watching tag \"%s\" using %d entries.\n", file.Name(), len(tp.entryarr))
+		if len(tp.sel.tags) == 0 {
+			tp.sel.tags = []string{name}
+		}
+		for i, t := range tp.sel.tags {
+			tp.sel.tags[i] = p.normalize(t)
+		}
+		p.attachStats(name, tp)
+
+		if tag, x := tp.sel.exactTag(); x {
+			if other, x := rs.tagmap[tag]; x {
+				return nil, fmt.Errorf("Tag \"%s\" is used by both %s and %s", tag, other.filename, tp.filename)
+			}
+			tp.Tag = tag
+			rs.tagmap[tag] = tp
+			fmt.Printf("Watching tag \"%s\" using %d entries.\n", tag, len(tp.entryarr))
+		} else {
+			tp.Tag = strings.Join(tp.sel.tags, ",")
+			rs.selected = append(rs.selected, tp)
+			fmt.Printf("Watching tags \"%s\" from %s using %d entries.\n", tp.Tag, name, len(tp.entryarr))
+		}
 	}
 
-	t0 = time.Now()
+	for _, pack := range p.opts.Packs {
+		if err := p.loadPack(rs, pack); err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
 
-	go p.reloader()
-	return p, nil
+// loadPack reads and compiles the rule files of a pack, leaving out rules
+// overridden by local rules. Local rules override rules with the same id in
+// pack files for their tag, or for a tag their file selects.
+func (p *Parser) loadPack(rs *ruleset, pack Pack) error {
+	files, err := ruleFiles(pack.FS, ".")
+	if err != nil {
+		return fmt.Errorf("Can't read rule pack %s: %v", pack.Name, err)
+	}
+	for _, name := range files {
+		fn := "packs/" + pack.Name + "/" + name
+		tp, err := p.newTagParser(pack.FS, name, fn)
+		if err != nil {
+			return err
+		}
+		if len(tp.sel.tags) == 0 {
+			tp.sel.tags = []string{name}
+		}
+		for i, t := range tp.sel.tags {
+			tp.sel.tags[i] = p.normalize(t)
+		}
+		tp.Tag = strings.Join(tp.sel.tags, ",")
+
+		var locals []*tagParser
+		for tag, local := range rs.tagmap {
+			if tp.sel.matchTag(tag) {
+				locals = append(locals, local)
+			}
+		}
+		for _, local := range rs.selected {
+			for _, tag := range tp.sel.tags {
+				if local.sel.matchTag(tag) {
+					locals = append(locals, local)
+					break
+				}
+			}
+		}
+		overridden := make(map[string]bool)
+		for _, local := range locals {
+			for _, e := range local.entryarr {
+				if e.ID != e.Md5 {
+					overridden[e.ID] = true
+				}
+			}
+		}
+		tp.drop(overridden)
+		p.attachStats(fn, tp)
+
+		rs.packs = append(rs.packs, tp)
+		fmt.Printf("Watching tags \"%s\" from rule pack %s using %d entries.\n", tp.Tag, pack.Name, len(tp.entryarr))
+	}
+	return nil
+}
+
+func (p *Parser) ruleset() *ruleset {
+	return p.rules.Load().(*ruleset)
 }
 
-func (p *Parser) reloader() {
+// Rules returns all loaded rules, ordered by file and position in the file.
+func (p *Parser) Rules() []*Logent {
+	rs := p.ruleset()
+	tps := append([]*tagParser(nil), rs.selected...)
+	for _, tp := range rs.tagmap {
+		tps = append(tps, tp)
+	}
+	sort.Slice(tps, func(i, j int) bool { return tps[i].filename < tps[j].filename })
+
+	var rules []*Logent
+	for _, tp := range append(tps, rs.packs...) {
+		rules = append(rules, tp.entryarr...)
+	}
+	return rules
+}
+
+// Reload reads the rules directory again. The new rules replace the current
+// ones only if all files are valid, on error the current rules stay in use.
+func (p *Parser) Reload() error {
+	rs, err := p.load()
+	if err != nil {
+		return err
+	}
+	p.rules.Store(rs)
+	return nil
+}
+
+// reloader reloads the rules when the rules directory changes. Changes are
+// picked up by watching the directory where supported, otherwise by polling.
+func (p *Parser) reloader(changed chan bool) {
 	for {
-		time.Sleep(time.Second * 10)
+		select {
+		case <-changed:
+		case <-p.quit:
+			return
+		}
+
+		// Wait for editors to finish writing and combine bursts of changes.
+		select {
+		case <-time.After(reloadDelay):
+		case <-p.quit:
+			return
+		}
+		select {
+		case <-changed:
+		default:
+		}
 
-		for _, tp := range p.tagmap {
-			fi, err := os.Stat(tp.filename)
+		err := p.Reload()
+		if err != nil {
+			fmt.Printf("Reloading rules from %s failed, keeping current rules: %v\n", p.path, err)
+		} else {
+			fmt.Printf("Reloaded rules from %s.\n", p.path)
+		}
+		if p.opts.OnReload != nil {
+			p.opts.OnReload(err)
+		}
+	}
+}
+
+// ruleFiles returns the names of all rule files below dir of fsys, relative
+// to the root of fsys.
+func ruleFiles(fsys fs.FS, dir string) ([]string, error) {
+	files, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		name := file.Name()
+		if dir != "." {
+			name = dir + "/" + name
+		}
+		if file.IsDir() {
+			sub, err := ruleFiles(fsys, name)
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
+			names = append(names, sub...)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
 
-			if fi.ModTime().After(tp.lastmod) {
-				newtp, err := p.newTagParser(tp.filename)
-				if err != nil {
-					panic(err)
-				}
-				newtp.Tag = tp.Tag
-				p.tagmap[tp.Tag] = newtp
-				fmt.Printf("Reloaded watched tag \"%s\" using %d entries.\n", tp.Tag, len(newtp.entryarr))
+// normalize applies the configured tag normalisations.
+func (p *Parser) normalize(tag string) string {
+	for _, n := range p.opts.Normalize {
+		switch n {
+		case "lower":
+			tag = strings.ToLower(tag)
+		case "trim":
+			tag = strings.TrimSuffix(strings.TrimSpace(tag), ":")
+		case "path":
+			if strings.HasPrefix(tag, "/") {
+				tag = tag[strings.LastIndex(tag, "/")+1:]
 			}
 		}
 	}
+	return tag
 }
 
-func (p *Parser) newTagParser(fn string) (*tagParser, error) {
-	f, err := os.Open(fn)
+// newTagParser reads rule file name of fsys, fn is its name in messages.
+func (p *Parser) newTagParser(fsys fs.FS, name, fn string) (*tagParser, error) {
+	ents, sel, err := readRules(fsys, name, fn)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	if err := p.checkNames(sel, ents, fn); err != nil {
+		return nil, err
+	}
 
 	tp := new(tagParser)
-	tp.entrymap = make(map[string]*Logent)
 	tp.filename = fn
+	tp.sel = sel
+	tp.setRules(ents)
+	return tp, nil
+}
 
-	fi, err := f.Stat()
-	if err != nil {
-		return nil, err
+// checkNames returns an error if a rule file selects on a host group which
+// is not in Options.HostGroups, or runs a command not in Options.Commands.
+func (p *Parser) checkNames(sel *selector, ents []*Logent, fn string) error {
+	for _, g := range sel.groups {
+		if _, x := p.opts.HostGroups[g]; !x {
+			return fmt.Errorf("Unknown host group %q in %s", g, fn)
+		}
 	}
-	tp.lastmod = fi.ModTime()
-
-	s := bufio.NewScanner(f)
-	i := 0
-	for s.Scan() {
-		i++
-		line := s.Text()
-		if line == "" || line[0] == '#' {
-			continue
+	for _, e := range ents {
+		for _, a := range e.Actions {
+			if a.Type == ActionExec && index(p.opts.Commands, a.Arg) < 0 {
+				return fmt.Errorf("Rule %s in %s runs unknown command %s", e.ID, fn, a.Arg)
+			}
 		}
+	}
+	return nil
+}
 
-		e := new(Logent)
-
-		if strings.HasPrefix(line, "!!") {
-			e.raw = strings.TrimPrefix(line, "!!")
-			e.Important = 2
-		} else if strings.HasPrefix(line, "!") {
-			e.raw = strings.TrimPrefix(line, "!")
-			e.Important = 1
-		} else {
-			e.raw = line
+// setRules sets the rules of a tagParser. The order of the file is kept,
+// rules with the same id are matched by the first one. Rules in the original
+// format use the sum of the line as id, so duplicate lines are dropped.
+func (tp *tagParser) setRules(ents []*Logent) {
+	tp.entrymap = make(map[string]*Logent)
+	tp.entryarr = make([]*Logent, 0, len(ents))
+	for _, e := range ents {
+		if _, x := tp.entrymap[e.ID]; x {
+			continue
 		}
+		tp.entrymap[e.ID] = e
+		tp.entryarr = append(tp.entryarr, e)
+	}
+	tp.pre = newPrefilter(tp.entryarr)
+}
 
-		e.rex, err = regexp.Compile(line)
-		if err != nil {
-			return nil, fmt.Errorf("Error on line %d of %s: %v", i, fn, err)
+// drop removes the rules with the given ids.
+func (tp *tagParser) drop(ids map[string]bool) {
+	if len(ids) == 0 {
+		return
+	}
+	var ents []*Logent
+	for _, e := range tp.entryarr {
+		if !ids[e.ID] {
+			ents = append(ents, e)
 		}
+	}
+	tp.setRules(ents)
+}
 
-		h := md5.New()
-		io.WriteString(h, line)
-		e.Md5 = fmt.Sprintf("%x", h.Sum(nil))
+// readRules reads all rules of rule file name of fsys in order, including
+// duplicates. Fn is the name of the file in messages.
+func readRules(fsys fs.FS, name, fn string) ([]*Logent, *selector, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
 
-		tp.entrymap[e.Md5] = e
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
 	}
 
-	tp.entryarr = make(logEntries, 0, len(tp.entrymap))
-	for _, x := range tp.entrymap {
-		tp.entryarr = append(tp.entryarr, x)
+	if len(lines) > 0 && strings.TrimSpace(lines[0]) == V2Header {
+		return parseV2(lines, fn)
 	}
-	return tp, nil
+	return parseV1(lines, fn)
 }
 
-var t0 time.Time
-
 // HasTag checks if a regex match list is available for a given tag.
+// Only rule files which select on tags alone are considered, use Selects
+// to include rule files which select on other message properties.
 func (p *Parser) HasTag(tag string) bool {
-	_, x := p.tagmap[tag]
-	return x
+	return len(p.tagParsersFor(tag, nil)) > 0
 }
 
-// Check checks for a regex match for tag "tag".
-// Returns Logent for the matched regex and true or false if matched.
-func (p *Parser) Check(tag, msg string) (*Logent, bool) {
-	tp, x := p.tagmap[tag]
-	if !x {
-		panic("Should be available.")
-		// return nil, false
-	}
+// Selects checks if any rule file applies to a message.
+func (p *Parser) Selects(m *syslogd.Message) bool {
+	return len(p.tagParsersFor(m.Tag, m)) > 0
+}
 
-	tp.totchecks++
-	if tp.totchecks%50000 == 0 {
-		tp.optimize()
-		//d := time.Now().Sub(t0)
-		//fmt.Printf("50klines %v %.2f/s\n", d, float64(50000.0/d.Seconds()))
-		//t0 = time.Now()
+// tagParsersFor returns the rule sets which apply to a tag, or to a message
+// if m is not nil. The file named after the tag comes first, followed by
+// other matching files in order of their file names and files of packs.
+func (p *Parser) tagParsersFor(tag string, m *syslogd.Message) []*tagParser {
+	tag = p.normalize(tag)
+	rs := p.ruleset()
+	var tps []*tagParser
+	if tp, x := rs.tagmap[tag]; x {
+		tps = append(tps, tp)
 	}
-
-	for i := 0; i < len(tp.entryarr); i++ {
-		e := tp.entryarr[i]
-		if e.rex.MatchString(msg) {
-			e.count++
-			return e, true
+	for _, list := range [][]*tagParser{rs.selected, rs.packs} {
+		for _, tp := range list {
+			if m != nil && tp.sel.matches(m, tag, p.opts.HostGroups) {
+				tps = append(tps, tp)
+			} else if m == nil && tp.sel.tagOnly() && tp.sel.matchTag(tag) {
+				tps = append(tps, tp)
+			}
 		}
 	}
-	return nil, false
+	return tps
 }
 
-// optimize sorts the logentries map into a sorted slice
-// ordered by most used first.
-func (tp *tagParser) optimize() {
-	sort.Sort(tp.entryarr)
+// Check checks for a regex match for tag "tag".
+// Returns Logent for the matched regex, the values of named capture groups
+// like (?P<user>\S+) if the regex has any, and true or false if matched.
+// Like HasTag, only rule files which select on tags alone are checked.
+func (p *Parser) Check(tag, msg string) (*Logent, map[string]string, bool) {
+	tps := p.tagParsersFor(tag, nil)
+	if len(tps) == 0 {
+		panic("Should be available.")
+	}
+	e, fields, x := check(tps, msg)
+	p.countTag(p.normalize(tag), x)
+	return e, fields, x
 }
 
-// Implement sort interface for log entries list.
-func (e logEntries) Len() int {
-	return len(e)
+// CheckMessage checks a message against all rule files which apply to it.
+// The first matching rule is returned, see Check. Rules are tried in the
+// order of their files, and files in the order of tagParsersFor.
+func (p *Parser) CheckMessage(m *syslogd.Message) (*Logent, map[string]string, bool) {
+	tps := p.tagParsersFor(m.Tag, m)
+	if len(tps) == 0 {
+		return nil, nil, false
+	}
+	e, fields, x := check(tps, string(m.Raw))
+	p.countTag(p.normalize(m.Tag), x)
+	return e, fields, x
 }
 
-func (e logEntries) Swap(i, j int) {
-	e[i], e[j] = e[j], e[i]
+func check(tps []*tagParser, msg string) (*Logent, map[string]string, bool) {
+	for _, tp := range tps {
+		if e, fields, x := tp.check(msg); x {
+			return e, fields, x
+		}
+	}
+	return nil, nil, false
 }
 
-func (e logEntries) Less(i, j int) bool {
-	return e[j].count < e[i].count
+// extract returns the named capture groups of a match.
+// Groups which did not participate in the match are left out.
+func (e *Logent) extract(sub []string) map[string]string {
+	fields := make(map[string]string)
+	for i, n := range e.rex.SubexpNames() {
+		if n != "" && sub[i] != "" {
+			fields[n] = sub[i]
+		}
+	}
+	return fields
 }
@@ -0,0 +1,732 @@
+package parser
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// newTestParser creates a parser from a map of file names to rule file contents.
+func newTestParser(t *testing.T, files map[string]string) *Parser {
+	return newTestParserWithOptions(t, files, Options{})
+}
+
+// newTestParserWithOptions is like newTestParser, using opts with the
+// path of the rule files.
+func newTestParserWithOptions(t *testing.T, files map[string]string, opts Options) *Parser {
+	dir, err := ioutil.TempDir("", "parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for fn, content := range files {
+		fn = filepath.Join(dir, fn)
+		os.MkdirAll(filepath.Dir(fn), 0755)
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts.Path = dir
+	p, err := NewWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestFields(t *testing.T) {
+	p := newTestParser(t, map[string]string{
+		"sshd": `^Failed password for (?P<user>\S+) from (?P<ip>\S+)` + "\n" + `^Accepted`,
+	})
+
+	e, fields, x := p.Check("sshd", "Failed password for root from 10.0.0.1 port 22 ssh2")
+	if !x {
+		t.Fatal("Expected a match")
+	}
+	if e.Regex() != `^Failed password for (?P<user>\S+) from (?P<ip>\S+)` {
+		t.Errorf("Matched wrong regex %s", e.Regex())
+	}
+	if fields["user"] != "root" || fields["ip"] != "10.0.0.1" {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+
+	_, fields, x = p.Check("sshd", "Accepted publickey for root")
+	if !x || fields != nil {
+		t.Errorf("Expected a match without fields, got %v %v", x, fields)
+	}
+}
+
+func TestFormatV2(t *testing.T) {
+	p := newTestParser(t, map[string]string{
+		"sshd": `#!v2
+# Rules for sshd.
+
+[failed-password]
+description = Failed password
+owner = security
+level = critical
+runbook = https://wiki.example.com/ssh
+action = publish:auth
+action = store
+match = ^Failed password for (?P<user>\S+)
+
+[accepted]
+dedup = 2m
+match = ^Accepted
+
+[invalid-user]
+threshold = 20/60s
+groupby = host, field:ip
+match = ^Invalid user \S+ from (?P<ip>\S+)
+`,
+		"cron": "!!^FAILED\n!^warning\n^ok\n",
+	})
+
+	e, _, x := p.Check("sshd", "Failed password for root")
+	if !x {
+		t.Fatal("Expected a match")
+	}
+	if e.ID != "failed-password" || e.Owner != "security" || e.Important != 2 || e.Runbook == "" {
+		t.Errorf("Unexpected metadata %+v", e)
+	}
+	if len(e.Actions) != 2 || e.Actions[0].String() != "publish:auth" || e.Actions[1].Type != ActionStore {
+		t.Errorf("Unexpected actions %v", e.Actions)
+	}
+
+	e, _, _ = p.Check("sshd", "Accepted publickey")
+	if e.ID != "accepted" || e.Actions != nil {
+		t.Errorf("Expected a normal rule without actions, got %+v", e)
+	}
+	if e.Dedup == nil || *e.Dedup != 2*time.Minute {
+		t.Errorf("Unexpected dedup %v", e.Dedup)
+	}
+
+	e, _, _ = p.Check("sshd", "Invalid user admin from 10.0.0.1")
+	th := e.Threshold
+	if th == nil || th.Count != 20 || th.Window != time.Minute || len(th.GroupBy) != 2 || th.GroupBy[1] != "field:ip" {
+		t.Errorf("Unexpected threshold %+v", th)
+	}
+	if len(e.Actions) != 1 || e.Actions[0].Type != ActionAlert {
+		t.Errorf("Expected a threshold rule to alert by default, got %v", e.Actions)
+	}
+
+	// The original format, prefixes set the level and are not part of the regex.
+	e, _, x = p.Check("cron", "FAILED to run")
+	if !x || e.Important != 2 || e.Actions[0].Type != ActionAlert {
+		t.Errorf("Expected a critical match, got %v %+v", x, e)
+	}
+	e, _, x = p.Check("cron", "warning: disk full")
+	if !x || e.Important != 1 || e.Actions[0].String() != "publish:important" {
+		t.Errorf("Expected an important match, got %v %+v", x, e)
+	}
+	if e.Regex() != "^warning" {
+		t.Errorf("Expected the prefix to be stripped, got %q", e.Regex())
+	}
+	if _, _, x = p.Check("cron", "!warning: disk full"); x {
+		t.Error("Expected the prefix not to be matched literally")
+	}
+}
+
+func TestFormatV2Errors(t *testing.T) {
+	bad := []string{
+		"#!v2\n[a]\naction = explode\nmatch = x\n",
+		"#!v2\n[a]\ndescription = no match\n",
+		"#!v2\n[a]\nmatch = x\n[a]\nmatch = y\n",
+		"#!v2\n[a]\nmatch = (\n",
+		"#!v2\n[a]\nlevel = 5\nmatch = x\n",
+		"#!v2\n[a]\nthreshold = 20\nmatch = x\n",
+		"#!v2\n[a]\nthreshold = 0/60s\nmatch = x\n",
+		"#!v2\n[a]\ngroupby = host\nmatch = x\n",
+		"#!v2\n[a]\nthreshold = 20/60s\ngroupby = ip\nmatch = x\n",
+		"#!v2\n[a]\ntransaction = id\nmatch = x\n",
+		"#!v2\n[a]\nend = true\nmatch = (?P<id>x)\n",
+		"#!v2\n[a]\ntransaction = id\noutcome = field:status\nmatch = (?P<id>x)\n",
+		"#!v2\n[a]\nexpect = daily\nmatch = x\n",
+		"#!v2\n[a]\nhosts = db1\nmatch = x\n",
+		"#!v2\n[a]\ngrace = 1h\nmatch = x\n",
+		"#!v2\n[a]\naction = ban\nmatch = from (?P<src>\\S+)\n",
+		"#!v2\n[a]\naction = exec\nmatch = x\n",
+		"#!v2\n[a]\ndedup = soon\nmatch = x\n",
+		"#!v2\n[a]\nmatch = x\n[b]\nlevel = critical\nmatch = x\n",
+		"#!v2\nhostgroup = web\n[a]\nmatch = x\n",
+		"#!v2\n[a]\naction = exec:restart\nmatch = x\n",
+		"#!v2\n[a]\nthreshold = 20/60s\ngroupby = field:ip\nmatch = from (?P<src>\\S+)\n",
+	}
+	for _, content := range bad {
+		dir, err := ioutil.TempDir("", "parser")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(filepath.Join(dir, "tag"), []byte(content), 0644)
+		if _, err := New(dir); err == nil {
+			t.Errorf("Expected an error for %q", content)
+		}
+		os.RemoveAll(dir)
+	}
+
+	// Configured commands can be run.
+	newTestParserWithOptions(t, map[string]string{"tag": "#!v2\n[a]\naction = exec:restart\nmatch = x\n"}, Options{Commands: []string{"restart"}})
+}
+
+func TestSelectors(t *testing.T) {
+	p := newTestParserWithOptions(t, map[string]string{
+		"sshd": "Accepted\n",
+		"web-auth": `#!v2
+tag = *
+hostgroup = web
+facility = auth, authpriv
+severity = warning
+
+[any]
+match = .
+`,
+		"pid1": "#!v2\ntag = init, systemd\npid = 1\n[pid1]\nmatch = .\n",
+	}, Options{HostGroups: map[string][]string{"web": {"web*"}}})
+
+	msg := func(pkt string) *syslogd.Message {
+		m, err := syslogd.NewMessage([]byte(pkt), len(pkt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	tests := []struct {
+		pkt  string
+		rule string
+	}{
+		{`<36>2016-03-12T11:10:49+01:00 web01 sudo[3]: auth failure`, "any"},
+		{`<38>2016-03-12T11:10:49+01:00 web01 sudo[3]: session opened`, ""},
+		{`<36>2016-03-12T11:10:49+01:00 db01 sudo[3]: auth failure`, ""},
+		{`<28>2016-03-12T11:10:49+01:00 web01 sudo[3]: auth failure`, ""},
+		{`<36>2016-03-12T11:10:49+01:00 web01 sshd[3]: Accepted publickey`, "sshd"},
+		{`<36>2016-03-12T11:10:49+01:00 web01 sshd[3]: Disconnected`, "any"},
+		{`<30>2016-03-12T11:10:49+01:00 db01 systemd[1]: Started`, "pid1"},
+		{`<30>2016-03-12T11:10:49+01:00 db01 systemd[2]: Started`, ""},
+	}
+	for _, tc := range tests {
+		m := msg(tc.pkt)
+		e, _, x := p.CheckMessage(m)
+		if tc.rule == "" {
+			if x {
+				t.Errorf("%s: expected no match, got %s", tc.pkt, e.ID)
+			}
+			continue
+		}
+		if !x {
+			t.Errorf("%s: expected a match", tc.pkt)
+			continue
+		}
+		if tc.rule == "sshd" {
+			if e.Regex() != "Accepted" {
+				t.Errorf("%s: expected the sshd file to match first, got %s", tc.pkt, e.ID)
+			}
+		} else if e.ID != tc.rule {
+			t.Errorf("%s: expected rule %s, got %s", tc.pkt, tc.rule, e.ID)
+		}
+	}
+
+	if !p.HasTag("sshd") || p.HasTag("sudo") {
+		t.Error("Expected HasTag to only consider files selecting on tags")
+	}
+}
+
+func TestSlashTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "postfix"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "postfix", "smtpd"), []byte("connect from\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "qmgr"), []byte("#!tag postfix/qmgr\nremoved\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "cron"), []byte("CMD\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".cron.swp"), []byte("(\n"), 0644)
+
+	p, err := NewWithOptions(Options{Path: dir, Normalize: []string{"trim", "lower", "path"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for _, tag := range []string{"postfix/smtpd", "postfix/qmgr", "Postfix/SMTPD", " cron:", "/usr/sbin/CRON"} {
+		if !p.HasTag(tag) {
+			t.Errorf("Expected tag %q to be monitored", tag)
+		}
+	}
+	if p.HasTag("qmgr") {
+		t.Error("Expected the tag directive to replace the file name")
+	}
+	if _, _, x := p.Check("postfix/smtpd", "connect from unknown"); !x {
+		t.Error("Expected a match for postfix/smtpd")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "cron"), []byte("CMD\n"), 0644)
+
+	reloads := make(chan error, 10)
+	p, err := NewWithOptions(Options{Path: dir, OnReload: func(err error) { reloads <- err }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	wait := func() error {
+		select {
+		case err := <-reloads:
+			return err
+		case <-time.After(15 * time.Second):
+			t.Fatal("Timeout waiting for reload")
+		}
+		return nil
+	}
+
+	// A broken file keeps the current rules.
+	ioutil.WriteFile(filepath.Join(dir, "sshd"), []byte("(\n"), 0644)
+	if err := wait(); err == nil {
+		t.Fatal("Expected reload to fail")
+	}
+	if !p.HasTag("cron") || p.HasTag("sshd") {
+		t.Error("Expected the current rules to stay in use")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "sshd"), []byte("Accepted\n"), 0644)
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.HasTag("sshd") {
+		t.Error("Expected the new file to be loaded")
+	}
+
+	os.Remove(filepath.Join(dir, "cron"))
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	if p.HasTag("cron") {
+		t.Error("Expected the removed file to be unloaded")
+	}
+
+	// A closed parser keeps its rules and stops reloading.
+	p.Close()
+	ioutil.WriteFile(filepath.Join(dir, "cron"), []byte("CMD\n"), 0644)
+	select {
+	case <-reloads:
+		t.Error("Expected no reload after Close")
+	case <-time.After(2 * reloadDelay):
+	}
+	if !p.HasTag("sshd") || p.HasTag("cron") {
+		t.Error("Expected the rules to stay in use after Close")
+	}
+}
+
+func TestLint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "cron"), []byte(
+		"#!example (root) CMD (run-parts)\n"+
+			"#!counterexample (root) LIST\n"+
+			"CMD\n"+
+			"CMD\n"+
+			"CMD \\(run\n"+
+			"!!!broken\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sshd"), []byte(`#!v2
+[accepted]
+match = Accepted
+example = Accepted publickey for root
+counterexample = Accepted password
+
+[any]
+match = .*
+
+[failed]
+match = Failed (?P<what>\S+)
+example = Failed password
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "bad"), []byte("(\n"), 0644)
+
+	problems, err := Lint(Options{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		file  string
+		line  int
+		fatal bool
+	}{
+		{"bad", 0, true},
+		{"cron", 4, false},
+		{"cron", 5, false},
+		{"cron", 6, false},
+		{"sshd", 2, true},
+		{"sshd", 10, false},
+		{"sshd", 10, true},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("Expected %d problems, got %d: %v", len(want), len(problems), problems)
+	}
+	for i, w := range want {
+		p := problems[i]
+		if p.File != filepath.Join(dir, w.file) || p.Line != w.line || p.Fatal != w.fatal {
+			t.Errorf("Expected problem %d at %s:%d fatal %v, got %v", i, w.file, w.line, w.fatal, p)
+		}
+	}
+}
+
+// benchRules returns n rules in the style of sshd and postfix rule files.
+func benchRules(n int) string {
+	var rules []string
+	for i := 0; i < n; i++ {
+		switch i % 4 {
+		case 0:
+			rules = append(rules, fmt.Sprintf(`Failed password for (?P<user>\S+) from \S+ port %d`, i))
+		case 1:
+			rules = append(rules, fmt.Sprintf(`connect from unknown\[10\.0\.%d\.\d+\]`, i))
+		case 2:
+			rules = append(rules, fmt.Sprintf(`^\S+ \S+ \S+ \S+ \S+: rule%d session (opened|closed)`, i))
+		default:
+			rules = append(rules, fmt.Sprintf(`status=(sent|deferred) \(queue %d\)`, i))
+		}
+	}
+	return strings.Join(rules, "\n")
+}
+
+var benchMessages = []string{
+	"2016-03-12T10:00:00+01:00 web1 sshd[42]: Failed password for root from 10.0.0.1 port 396",
+	"2016-03-12T10:00:00+01:00 web1 sshd[42]: connect from unknown[10.0.201.7]",
+	"2016-03-12T10:00:00+01:00 web1 sshd[42]: rule398 session opened",
+	"2016-03-12T10:00:00+01:00 web1 sshd[42]: status=sent (queue 399)",
+	"2016-03-12T10:00:00+01:00 web1 sshd[42]: something nobody wrote a rule for",
+}
+
+func TestPrefilter(t *testing.T) {
+	p := newTestParser(t, map[string]string{"sshd": benchRules(400) + "\n(?i)WARNING\n.*"})
+	tp := p.ruleset().tagmap["sshd"]
+	if tp.pre == nil {
+		t.Fatal("Expected a prefilter")
+	}
+	for _, msg := range benchMessages {
+		e1, _, x1 := tp.check(msg)
+		e2, _, x2 := tp.checkLinear(msg)
+		if e1 != e2 || x1 != x2 {
+			t.Errorf("Prefilter and linear match differ for %q", msg)
+		}
+	}
+	if e, _, _ := tp.check(benchMessages[4]); e.Regex() != ".*" {
+		t.Errorf("Expected the catch all rule to match, got %s", e.Regex())
+	}
+}
+
+// countSorted is the matching of the original parser, kept to benchmark
+// against: rules are tried in order of their match counts, which are
+// resorted every 50000 checks.
+type countSorted struct {
+	rules  []*countRule
+	checks int
+}
+
+type countRule struct {
+	rex   *regexp.Regexp
+	count int64
+}
+
+func newCountSorted(tp *tagParser) *countSorted {
+	cs := new(countSorted)
+	for _, e := range tp.entryarr {
+		cs.rules = append(cs.rules, &countRule{rex: regexp.MustCompile(e.raw)})
+	}
+	return cs
+}
+
+func (cs *countSorted) check(msg string) bool {
+	cs.checks++
+	if cs.checks%50000 == 0 {
+		sort.Slice(cs.rules, func(i, j int) bool { return cs.rules[j].count < cs.rules[i].count })
+	}
+	for _, r := range cs.rules {
+		if r.rex.MatchString(msg) {
+			r.count++
+			return true
+		}
+	}
+	return false
+}
+
+func benchmarkCheck(b *testing.B, mode string) {
+	dir, err := ioutil.TempDir("", "parser")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "sshd"), []byte(benchRules(400)), 0644)
+	p, err := New(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tp := p.ruleset().tagmap["sshd"]
+	cs := newCountSorted(tp)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg := benchMessages[i%len(benchMessages)]
+		switch mode {
+		case "prefilter":
+			tp.check(msg)
+		case "linear":
+			tp.checkLinear(msg)
+		case "countsorted":
+			cs.check(msg)
+		}
+	}
+}
+
+func BenchmarkCheckPrefilter(b *testing.B)   { benchmarkCheck(b, "prefilter") }
+func BenchmarkCheckLinear(b *testing.B)      { benchmarkCheck(b, "linear") }
+func BenchmarkCheckCountSorted(b *testing.B) { benchmarkCheck(b, "countsorted") }
+
+func TestConcurrentCheck(t *testing.T) {
+	p := newTestParser(t, map[string]string{"sshd": benchRules(40)})
+
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func() {
+			for j := 0; j < 1000; j++ {
+				m := &syslogd.Message{Tag: "sshd", Priority: syslogd.NoPriority, Raw: []byte(benchMessages[j%len(benchMessages)])}
+				p.CheckMessage(m)
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err := p.Reload(); err != nil {
+			t.Error(err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "rules"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "rules", "cron"), []byte("CMD\nLIST\n"), 0644)
+
+	opts := Options{Path: filepath.Join(dir, "rules"), StatsFile: filepath.Join(dir, "stats")}
+	p, err := NewWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for i := 0; i < 10; i++ {
+		p.Check("cron", fmt.Sprintf("(root) CMD %d", i))
+	}
+
+	// Statistics survive reloads which change other rules.
+	ioutil.WriteFile(filepath.Join(dir, "rules", "cron"), []byte("LIST\nCMD\nEDIT\n"), 0644)
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	p.Check("cron", "(root) CMD 10")
+	if err := p.SaveStats(); err != nil {
+		t.Fatal(err)
+	}
+
+	// And restarts.
+	p.Close()
+	p, err = NewWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	stats := p.Stats()
+	if len(stats) != 3 {
+		t.Fatalf("Expected stats of 3 rules, got %d", len(stats))
+	}
+	s := stats[1]
+	if s.Regex != "CMD" || s.Count != 11 || len(s.Examples) != reservoirSize || s.First.IsZero() || s.Last.Before(s.First) {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+	if stats[0].Count != 0 || stats[0].Examples != nil {
+		t.Errorf("Expected no matches of LIST, got %+v", stats[0])
+	}
+	if ts := p.TagStats(); len(ts) != 1 || ts[0].Messages != 11 || ts[0].Coverage() != 100 {
+		t.Errorf("Unexpected tag stats %+v", ts)
+	}
+}
+
+func TestStatsV1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "rules"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "rules", "cron"), []byte("CMD\nLIST\n"), 0644)
+
+	// Statistics files used to be a list of rule statistics.
+	sf := filepath.Join(dir, "stats")
+	ioutil.WriteFile(sf, []byte(`[
+{"File":"cron","Md5":"`+sum("CMD")+`","ID":"`+sum("CMD")+`","Regex":"CMD","Count":4,"First":"2016-03-12T11:10:49Z","Last":"2016-03-13T11:10:49Z"},
+{"File":"cron","Md5":"`+sum("LIST")+`","ID":"`+sum("LIST")+`","Regex":"LIST","Count":0}
+]`), 0644)
+
+	rules, tags, err := ReadStats(sf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Count != 4 || !rules[1].Added.IsZero() || tags != nil {
+		t.Errorf("Unexpected stats %+v %+v", rules, tags)
+	}
+	r := NewReport(rules, tags, time.Now(), 24*time.Hour, 50)
+	if len(r.Dead) != 0 || len(r.Stale) != 1 {
+		t.Errorf("Expected only a stale rule, got %+v", r)
+	}
+
+	p, err := NewWithOptions(Options{Path: filepath.Join(dir, "rules"), StatsFile: sf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	stats := p.Stats()
+	if len(stats) != 2 || stats[0].Count != 4 || stats[1].Added.IsZero() {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	ioutil.WriteFile(sf, []byte("{broken"), 0644)
+	if _, _, err := ReadStats(sf); err == nil {
+		t.Error("Expected an error for a broken file")
+	}
+}
+
+func TestReport(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	rules := []RuleStats{
+		{Regex: "new", Added: now.Add(-day)},
+		{Regex: "dead", Added: now.Add(-100 * day)},
+		{Regex: "unknown"},
+		{Regex: "stale", Added: now.Add(-100 * day), Count: 3, Last: now.Add(-40 * day)},
+		{Regex: "used", Added: now.Add(-100 * day), Count: 3, Last: now.Add(-day)},
+	}
+	tags := []TagStats{
+		{Tag: "sshd", Messages: 100, Matched: 90},
+		{Tag: "cron", Messages: 100, Matched: 10},
+		{Tag: "su"},
+	}
+
+	r := NewReport(rules, tags, now, 30*day, 50)
+	if len(r.Dead) != 1 || r.Dead[0].Regex != "dead" {
+		t.Errorf("Expected only the dead rule, got %v", r.Dead)
+	}
+	if len(r.Stale) != 1 || r.Stale[0].Regex != "stale" {
+		t.Errorf("Expected only the stale rule, got %v", r.Stale)
+	}
+	if len(r.LowCoverage) != 1 || r.LowCoverage[0].Tag != "cron" {
+		t.Errorf("Expected only cron to have low coverage, got %v", r.LowCoverage)
+	}
+}
+
+func TestPacks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "sshd"), []byte(`#!v2
+[failed-password]
+match = Failed password for root
+
+[deploy]
+action = ignore
+match = Accepted publickey for deploy
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "scheduled"), []byte(`#!v2
+tag = CRON, anacron
+
+[cmd]
+match = CMD \(backup\)
+`), 0644)
+
+	pack := fstest.MapFS{
+		"sshd": {Data: []byte(`#!v2
+tag = sshd
+
+[failed-password]
+level = critical
+match = Failed password for (?P<user>\S+)
+
+[accepted]
+match = Accepted \S+ for (?P<user>\S+)
+`)},
+		"cron": {Data: []byte("#!v2\ntag = CRON, cron\n[cmd]\nmatch = CMD\n")},
+	}
+	opts := Options{Path: dir, Packs: []Pack{{Name: "base", FS: pack}}}
+	p, err := NewWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	tests := []struct {
+		tag, msg, id string
+	}{
+		{"sshd", "Failed password for root", "failed-password"},
+		{"sshd", "Accepted publickey for deploy", "deploy"},
+		{"sshd", "Accepted password for alice", "accepted"},
+		// The local rule replaces the rule of the pack with the same id.
+		{"sshd", "Failed password for alice", ""},
+		// Also when the local file selects the tag of the pack.
+		{"CRON", "(root) CMD (true)", ""},
+		{"CRON", "(root) CMD (backup)", "cmd"},
+	}
+	for _, test := range tests {
+		e, _, x := p.Check(test.tag, test.msg)
+		if test.id == "" {
+			if x {
+				t.Errorf("Expected no match for %s, got %s", test.msg, e.ID)
+			}
+			continue
+		}
+		if !x || e.ID != test.id {
+			t.Errorf("Expected rule %s to match %s, got %v %+v", test.id, test.msg, x, e)
+		}
+	}
+	if e, _, _ := p.Check("sshd", "Failed password for root"); e.Important != 0 {
+		t.Errorf("Expected the local rule, got level %d", e.Important)
+	}
+	if n := len(p.Rules()); n != 4 {
+		t.Errorf("Expected 4 rules, got %d", n)
+	}
+
+	problems, err := Lint(opts)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Unexpected problems %v %v", err, problems)
+	}
+}
@@ -0,0 +1,46 @@
+package parser
+
+import (
+	"time"
+)
+
+// Report lists rules and tags which are candidates for pruning, see
+// NewReport.
+type Report struct {
+	// Stale rules matched before, but not within the report age.
+	Stale []RuleStats
+	// Dead rules never matched, and were loaded longer ago than the
+	// report age. Rules loaded at an unknown time are never dead.
+	Dead []RuleStats
+	// LowCoverage tags have less than the minimum percentage of their
+	// messages matched by a rule.
+	LowCoverage []TagStats
+}
+
+// NewReport creates a report from rule and tag statistics. Rules are stale
+// or dead if they have not matched for age, tags have low coverage if less
+// than minCoverage percent of their messages matched a rule.
+func NewReport(rules []RuleStats, tags []TagStats, now time.Time, age time.Duration, minCoverage float64) *Report {
+	r := new(Report)
+	since := now.Add(-age)
+	for _, s := range rules {
+		switch {
+		case s.Count == 0 && !s.Added.IsZero() && s.Added.Before(since):
+			r.Dead = append(r.Dead, s)
+		case s.Count > 0 && s.Last.Before(since):
+			r.Stale = append(r.Stale, s)
+		}
+	}
+	for _, s := range tags {
+		if s.Messages > 0 && s.Coverage() < minCoverage {
+			r.LowCoverage = append(r.LowCoverage, s)
+		}
+	}
+	return r
+}
+
+// Report creates a report from the statistics of the loaded rules, see
+// NewReport.
+func (p *Parser) Report(age time.Duration, minCoverage float64) *Report {
+	return NewReport(p.Stats(), p.TagStats(), time.Now(), age, minCoverage)
+}
@@ -0,0 +1,567 @@
+package parser
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tomarus/gosyslogd/cron"
+)
+
+// V2Header must be the first line of a rule file in the v2 format.
+//
+// A v2 rule file contains sections, one per rule, which start with the rule
+// id in brackets followed by "key = value" lines. Empty lines and lines
+// starting with "#" are ignored. Lines before the first section contain
+// settings for the whole file, which select the messages the rules apply to.
+// See selector for the available settings. By default a file applies to the
+// tag with the same name as the file.
+//
+//	#!v2
+//	tag = *
+//	hostgroup = web
+//	facility = auth, authpriv
+//
+//	[root-login]
+//	level = critical
+//	match = session opened for user root
+//
+// A file with rules for sshd:
+//
+//	#!v2
+//	[failed-password]
+//	description = Failed password for an existing user
+//	owner = security
+//	level = critical
+//	runbook = https://wiki.example.com/ssh
+//	action = alert
+//	action = publish:auth
+//	match = ^Failed password for (?P<user>\S+) from (?P<ip>\S+)
+//
+// Rule keys:
+//
+//	match           the regex, required
+//	description     free form description of the rule
+//	owner           team or person responsible for the rule
+//	level           normal (0), important (1) or critical (2), default normal
+//	runbook         link to documentation on how to handle a match
+//	action          what to do on a match, may be repeated, see Action
+//	example         a line this rule must match, may be repeated
+//	counterexample  a line this rule must not match, may be repeated
+//	threshold       only act after count matches within a window, "20/60s"
+//	groupby         count matches per host, tag or field, "field:ip"
+//	transaction     named capture group grouping lines into transactions
+//	outcome         outcome of the transaction, text or "field:name"
+//	end             "true" if the rule ends the transaction
+//	expect          alert if the rule does not match, see Expect
+//	grace           time after a scheduled time the match may arrive
+//	perhost         "true" to expect a match from every host seen before
+//	hosts           hosts a match is expected from
+//	dedup           window repeats are collapsed in, "60s", or "off"
+//
+// Examples are checked by Lint, they are not used when matching. Rules with
+// a threshold are counted by the correlate package, their actions run when
+// the threshold is crossed. Rules with a threshold and without actions
+// alert. Rules with a transaction are grouped by the transaction package.
+// Rules with expect are watched by the expect package. Dedup overrides the
+// configured deduplication of the tag for matches of the rule.
+//
+// Rules without actions get the default actions of their level, critical
+// rules alert and important rules publish to the "important" channel.
+// Rule ids and matches must be unique within a file.
+//
+// Files without the header use the original format, one regex per line.
+// A regex prefixed with "!" is important, one prefixed with "!!" critical.
+// Lines starting with "#" are comments, except for a "#!tag" line which
+// sets the tag of the file, e.g. "#!tag postfix/smtpd", and "#!example"
+// and "#!counterexample" lines which add a test case to the next regex.
+const V2Header = "#!v2"
+
+// Action types.
+const (
+	// ActionIgnore only counts the match, the message is not stored.
+	ActionIgnore = "ignore"
+	// ActionStore stores the message in PostgreSQL.
+	ActionStore = "store"
+	// ActionPublish publishes the message to the Redis channel in Arg.
+	ActionPublish = "publish"
+	// ActionAlert stores the message and publishes it to the "critical" channel.
+	ActionAlert = "alert"
+	// ActionBan counts a failure of the IP address in the capture group in
+	// Arg, default "ip", and bans it after too many failures.
+	ActionBan = "ban"
+	// ActionExec runs the command named in Arg from the configuration.
+	ActionExec = "exec"
+)
+
+// DefaultBanField is the capture group of the IP address of ban actions
+// without an argument.
+const DefaultBanField = "ip"
+
+// Action defines what is done with a message when a rule matches.
+// Actions are written as "type" or "type:arg".
+type Action struct {
+	Type string
+	Arg  string
+}
+
+func (a Action) String() string {
+	if a.Arg == "" {
+		return a.Type
+	}
+	return a.Type + ":" + a.Arg
+}
+
+func parseAction(s string) (Action, error) {
+	a := Action{Type: s}
+	if n := strings.Index(s, ":"); n >= 0 {
+		a.Type, a.Arg = s[:n], s[n+1:]
+	}
+	switch a.Type {
+	case ActionIgnore, ActionStore, ActionAlert:
+		if a.Arg != "" {
+			return a, fmt.Errorf("action %s takes no argument", a.Type)
+		}
+	case ActionPublish:
+		if a.Arg == "" {
+			return a, fmt.Errorf("action %s requires a channel", a.Type)
+		}
+	case ActionExec:
+		if a.Arg == "" {
+			return a, fmt.Errorf("action %s requires a command name", a.Type)
+		}
+	case ActionBan:
+		if a.Arg == "" {
+			a.Arg = DefaultBanField
+		}
+	default:
+		return a, fmt.Errorf("unknown action %q", s)
+	}
+	return a, nil
+}
+
+// Threshold configures a rule which only acts when it matches at least
+// Count times within Window.
+type Threshold struct {
+	Count  int
+	Window time.Duration
+	// GroupBy lists what matches are counted by: "host", "tag" or
+	// "field:name" for a named capture group. Empty counts all matches
+	// of the rule together.
+	GroupBy []string
+}
+
+// parseThreshold parses "count/window", like "20/60s".
+func parseThreshold(s string) (*Threshold, error) {
+	n := strings.Index(s, "/")
+	if n < 0 {
+		return nil, fmt.Errorf("invalid threshold %q, expected count/window", s)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(s[:n]))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid threshold count %q", s[:n])
+	}
+	window, err := time.ParseDuration(strings.TrimSpace(s[n+1:]))
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("invalid threshold window %q", s[n+1:])
+	}
+	return &Threshold{Count: count, Window: window}, nil
+}
+
+func parseGroupBy(s string) ([]string, error) {
+	l := splitList(s)
+	for _, g := range l {
+		if g != "host" && g != "tag" && (!strings.HasPrefix(g, "field:") || g == "field:") {
+			return nil, fmt.Errorf("invalid groupby %q", g)
+		}
+	}
+	return l, nil
+}
+
+// Transaction configures a rule whose matches are part of a transaction,
+// like all lines of a postfix queue id.
+type Transaction struct {
+	// Field is the named capture group containing the transaction id.
+	Field string
+	// Outcome, if set, is the outcome of the transaction when the rule
+	// matches. "field:name" takes it from a named capture group.
+	Outcome string
+	// End is true if the rule matches the last line of a transaction.
+	End bool
+}
+
+// Expect configures a rule which is expected to match on a schedule, like
+// the success message of a nightly backup. The schedule is an interval,
+// "expect = 25h" alerts if the rule did not match for 25 hours, or a cron
+// schedule, "expect = 0 3 * * *" alerts if the rule did not match between
+// 03:00 and the end of the grace period, default one hour.
+type Expect struct {
+	Interval time.Duration
+	Schedule *cron.Schedule
+	Grace    time.Duration
+	// PerHost expects a match from every host the rule matched before,
+	// Hosts from each of the listed hosts. Otherwise a match of any host
+	// will do.
+	PerHost bool
+	Hosts   []string
+}
+
+func (x *Expect) String() string {
+	if x.Schedule != nil {
+		return x.Schedule.String()
+	}
+	return x.Interval.String()
+}
+
+func parseExpect(s string) (*Expect, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid expect interval %q", s)
+		}
+		return &Expect{Interval: d}, nil
+	}
+	sched, err := cron.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Expect{Schedule: sched, Grace: time.Hour}, nil
+}
+
+// defaultActions returns the actions of a rule which has none configured.
+func defaultActions(level int) []Action {
+	switch {
+	case level >= 2:
+		return []Action{{Type: ActionAlert}}
+	case level == 1:
+		return []Action{{Type: ActionPublish, Arg: "important"}}
+	}
+	return nil
+}
+
+var levels = map[string]int{"normal": 0, "important": 1, "critical": 2}
+
+func parseLevel(s string) (int, error) {
+	if l, x := levels[s]; x {
+		return l, nil
+	}
+	l, err := strconv.Atoi(s)
+	if err != nil || l < 0 || l > 2 {
+		return 0, fmt.Errorf("invalid level %q", s)
+	}
+	return l, nil
+}
+
+func sum(s string) string {
+	h := md5.New()
+	io.WriteString(h, s)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// compile compiles the regex of a Logent.
+func (e *Logent) compile() error {
+	var err error
+	e.rex, err = regexp.Compile(e.raw)
+	if err != nil {
+		return err
+	}
+	for _, n := range e.rex.SubexpNames() {
+		if n != "" {
+			e.fields = true
+		}
+	}
+	return nil
+}
+
+// Directives of rule files in the original format.
+const (
+	tagDirective            = "#!tag "
+	exampleDirective        = "#!example "
+	counterexampleDirective = "#!counterexample "
+)
+
+// parseV1 parses the original rule format, one regex per line.
+func parseV1(lines []string, fn string) ([]*Logent, *selector, error) {
+	var ents []*Logent
+	var examples, counterexamples []string
+	sel := newSelector()
+	for i, line := range lines {
+		if strings.HasPrefix(line, exampleDirective) {
+			examples = append(examples, strings.TrimPrefix(line, exampleDirective))
+			continue
+		}
+		if strings.HasPrefix(line, counterexampleDirective) {
+			counterexamples = append(counterexamples, strings.TrimPrefix(line, counterexampleDirective))
+			continue
+		}
+		if strings.HasPrefix(line, tagDirective) {
+			tag := strings.TrimSpace(strings.TrimPrefix(line, tagDirective))
+			if tag == "" || len(sel.tags) > 0 {
+				return nil, nil, fmt.Errorf("Error on line %d of %s: invalid tag directive", i+1, fn)
+			}
+			sel.tags = []string{tag}
+			continue
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		e := &Logent{line: i + 1, examples: examples, counterexamples: counterexamples}
+		examples, counterexamples = nil, nil
+		if strings.HasPrefix(line, "!!") {
+			e.raw = strings.TrimPrefix(line, "!!")
+			e.Important = 2
+		} else if strings.HasPrefix(line, "!") {
+			e.raw = strings.TrimPrefix(line, "!")
+			e.Important = 1
+		} else {
+			e.raw = line
+		}
+		if err := e.compile(); err != nil {
+			return nil, nil, fmt.Errorf("Error on line %d of %s: %v", i+1, fn, err)
+		}
+
+		// The sum includes the prefix to stay compatible with stored matches.
+		e.Md5 = sum(line)
+		e.ID = e.Md5
+		e.Actions = defaultActions(e.Important)
+		ents = append(ents, e)
+	}
+	return ents, sel, nil
+}
+
+// parseV2 parses the v2 rule format, see V2Header.
+func parseV2(lines []string, fn string) ([]*Logent, *selector, error) {
+	var ents []*Logent
+	var e *Logent
+	var groupBy []string
+	var tr *Transaction
+	var ex *Expect
+	var grace time.Duration
+	sel := newSelector()
+	ids := make(map[string]bool)
+	matches := make(map[string]string)
+
+	finish := func() error {
+		if e == nil {
+			return nil
+		}
+		if e.raw == "" {
+			return fmt.Errorf("Rule %s in %s has no match", e.ID, fn)
+		}
+		if groupBy != nil {
+			if e.Threshold == nil {
+				return fmt.Errorf("Rule %s in %s has groupby without threshold", e.ID, fn)
+			}
+			for _, g := range groupBy {
+				if f := strings.TrimPrefix(g, "field:"); f != g && e.rex.SubexpIndex(f) < 0 {
+					return fmt.Errorf("Rule %s in %s has no capture group %s", e.ID, fn, f)
+				}
+			}
+			e.Threshold.GroupBy = groupBy
+		}
+		if tr != nil {
+			if tr.Field == "" {
+				return fmt.Errorf("Rule %s in %s has outcome or end without transaction", e.ID, fn)
+			}
+			if e.rex.SubexpIndex(tr.Field) < 0 {
+				return fmt.Errorf("Rule %s in %s has no capture group %s", e.ID, fn, tr.Field)
+			}
+			if f := strings.TrimPrefix(tr.Outcome, "field:"); f != tr.Outcome && e.rex.SubexpIndex(f) < 0 {
+				return fmt.Errorf("Rule %s in %s has no capture group %s", e.ID, fn, f)
+			}
+			e.Transaction = tr
+		}
+		if ex != nil {
+			if ex.Interval == 0 && ex.Schedule == nil {
+				return fmt.Errorf("Rule %s in %s has grace, perhost or hosts without expect", e.ID, fn)
+			}
+			if grace > 0 {
+				ex.Grace = grace
+			}
+			e.Expect = ex
+		}
+		for _, a := range e.Actions {
+			if a.Type == ActionBan && e.rex.SubexpIndex(a.Arg) < 0 {
+				return fmt.Errorf("Rule %s in %s has no capture group %s", e.ID, fn, a.Arg)
+			}
+		}
+		if e.Actions == nil && e.Threshold != nil {
+			e.Actions = []Action{{Type: ActionAlert}}
+		}
+		if e.Actions == nil {
+			e.Actions = defaultActions(e.Important)
+		}
+		ents = append(ents, e)
+		return nil
+	}
+
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		errorf := func(format string, a ...interface{}) error {
+			return fmt.Errorf("Error on line %d of %s: %s", i+1, fn, fmt.Sprintf(format, a...))
+		}
+
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			if err := finish(); err != nil {
+				return nil, nil, err
+			}
+			id := strings.TrimSpace(line[1 : len(line)-1])
+			if id == "" {
+				return nil, nil, errorf("empty rule id")
+			}
+			if ids[id] {
+				return nil, nil, errorf("duplicate rule id %s", id)
+			}
+			ids[id] = true
+			e = &Logent{ID: id, line: i + 1}
+			groupBy, tr, ex, grace = nil, nil, nil, 0
+			continue
+		}
+
+		n := strings.Index(line, "=")
+		if n < 0 {
+			return nil, nil, errorf("expected key = value")
+		}
+		key := strings.TrimSpace(line[:n])
+		val := strings.TrimSpace(line[n+1:])
+
+		if e == nil {
+			known, err := sel.set(key, val)
+			if err != nil {
+				return nil, nil, errorf("%v", err)
+			}
+			if !known {
+				return nil, nil, errorf("unknown file setting %q", key)
+			}
+			continue
+		}
+
+		switch key {
+		case "match":
+			if e.raw != "" {
+				return nil, nil, errorf("rule %s has more than one match", e.ID)
+			}
+			if id, x := matches[val]; x {
+				return nil, nil, errorf("rule %s has the same match as rule %s", e.ID, id)
+			}
+			matches[val] = e.ID
+			e.raw = val
+			if err := e.compile(); err != nil {
+				return nil, nil, errorf("%v", err)
+			}
+			e.Md5 = sum(val)
+		case "description":
+			e.Description = val
+		case "owner":
+			e.Owner = val
+		case "runbook":
+			e.Runbook = val
+		case "level":
+			l, err := parseLevel(val)
+			if err != nil {
+				return nil, nil, errorf("%v", err)
+			}
+			e.Important = l
+		case "action":
+			a, err := parseAction(val)
+			if err != nil {
+				return nil, nil, errorf("%v", err)
+			}
+			e.Actions = append(e.Actions, a)
+		case "example":
+			e.examples = append(e.examples, val)
+		case "counterexample":
+			e.counterexamples = append(e.counterexamples, val)
+		case "threshold":
+			t, err := parseThreshold(val)
+			if err != nil {
+				return nil, nil, errorf("%v", err)
+			}
+			e.Threshold = t
+		case "groupby":
+			g, err := parseGroupBy(val)
+			if err != nil {
+				return nil, nil, errorf("%v", err)
+			}
+			groupBy = g
+		case "transaction", "outcome", "end":
+			if tr == nil {
+				tr = new(Transaction)
+			}
+			switch key {
+			case "transaction":
+				tr.Field = val
+			case "outcome":
+				tr.Outcome = val
+			case "end":
+				end, err := strconv.ParseBool(val)
+				if err != nil {
+					return nil, nil, errorf("invalid end %q", val)
+				}
+				tr.End = end
+			}
+		case "expect":
+			x, err := parseExpect(val)
+			if err != nil {
+				return nil, nil, errorf("%v", err)
+			}
+			if ex != nil {
+				x.PerHost, x.Hosts = ex.PerHost, ex.Hosts
+			}
+			ex = x
+		case "grace":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return nil, nil, errorf("invalid grace %q", val)
+			}
+			if ex == nil {
+				ex = new(Expect)
+			}
+			grace = d
+		case "dedup":
+			d, err := parseDedup(val)
+			if err != nil {
+				return nil, nil, errorf("%v", err)
+			}
+			e.Dedup = &d
+		case "perhost", "hosts":
+			if ex == nil {
+				ex = new(Expect)
+			}
+			if key == "hosts" {
+				ex.Hosts = splitList(val)
+				break
+			}
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, nil, errorf("invalid perhost %q", val)
+			}
+			ex.PerHost = b
+		default:
+			return nil, nil, errorf("unknown key %q", key)
+		}
+	}
+	if err := finish(); err != nil {
+		return nil, nil, err
+	}
+	return ents, sel, nil
+}
+
+// parseDedup parses a dedup window, "off" disables deduplication.
+func parseDedup(s string) (time.Duration, error) {
+	if s == "off" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid dedup %q", s)
+	}
+	return d, nil
+}
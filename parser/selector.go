@@ -0,0 +1,169 @@
+package parser
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// selector decides which messages a rule file applies to. It is configured
+// by the file settings of a v2 rule file:
+//
+//	tag       = sshd, postfix/*   tag glob patterns, default the file name
+//	host      = web*, db1         host glob patterns
+//	hostgroup = web               host groups from Options.HostGroups
+//	facility  = auth, authpriv    facility names
+//	severity  = warning           this severity or anything more severe
+//	pid       = 1                 process ids
+//
+// A message must match every configured setting, and one of the values
+// of a setting. Multiple values are separated by commas.
+type selector struct {
+	tags       []string
+	hosts      []string
+	groups     []string
+	facilities []string
+	severity   int
+	pids       []int
+}
+
+func newSelector() *selector {
+	return &selector{severity: -1}
+}
+
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+func index(l []string, s string) int {
+	for i, v := range l {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// set parses a file setting. Returns false if key is not a selector setting.
+func (s *selector) set(key, val string) (bool, error) {
+	vals := splitList(val)
+	switch key {
+	case "tag":
+		for _, v := range vals {
+			if _, err := path.Match(v, ""); err != nil {
+				return true, fmt.Errorf("invalid tag pattern %q", v)
+			}
+		}
+		s.tags = append(s.tags, vals...)
+	case "host":
+		for _, v := range vals {
+			if _, err := path.Match(v, ""); err != nil {
+				return true, fmt.Errorf("invalid host pattern %q", v)
+			}
+		}
+		s.hosts = append(s.hosts, vals...)
+	case "hostgroup":
+		s.groups = append(s.groups, vals...)
+	case "facility":
+		for _, v := range vals {
+			if syslogd.ParseFacility(v) < 0 {
+				return true, fmt.Errorf("unknown facility %q", v)
+			}
+		}
+		s.facilities = append(s.facilities, vals...)
+	case "severity":
+		s.severity = syslogd.ParseSeverity(val)
+		if s.severity < 0 {
+			return true, fmt.Errorf("unknown severity %q", val)
+		}
+	case "pid":
+		for _, v := range vals {
+			pid, err := strconv.Atoi(v)
+			if err != nil {
+				return true, fmt.Errorf("invalid pid %q", v)
+			}
+			s.pids = append(s.pids, pid)
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// exactTag returns the tag if the selector selects on a single tag
+// without wildcards and nothing else.
+func (s *selector) exactTag() (string, bool) {
+	if len(s.tags) != 1 || strings.ContainsAny(s.tags[0], "*?[\\") {
+		return "", false
+	}
+	if !s.tagOnly() {
+		return "", false
+	}
+	return s.tags[0], true
+}
+
+// tagOnly returns true if the selector only selects on tags.
+func (s *selector) tagOnly() bool {
+	return len(s.hosts) == 0 && len(s.groups) == 0 && len(s.facilities) == 0 &&
+		s.severity < 0 && len(s.pids) == 0
+}
+
+func (s *selector) matchTag(tag string) bool {
+	return matchAny(s.tags, tag)
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if a message is selected. Tag is the normalised
+// tag of the message.
+func (s *selector) matches(m *syslogd.Message, tag string, groups map[string][]string) bool {
+	if !s.matchTag(tag) {
+		return false
+	}
+	if len(s.hosts) > 0 || len(s.groups) > 0 {
+		ok := matchAny(s.hosts, m.Hostname)
+		for _, g := range s.groups {
+			ok = ok || matchAny(groups[g], m.Hostname)
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(s.facilities) > 0 || s.severity >= 0 {
+		if m.Priority == syslogd.NoPriority {
+			return false
+		}
+		if len(s.facilities) > 0 && index(s.facilities, m.Facility()) < 0 {
+			return false
+		}
+		if s.severity >= 0 && int(m.Priority&7) > s.severity {
+			return false
+		}
+	}
+	if len(s.pids) > 0 {
+		ok := false
+		for _, pid := range s.pids {
+			ok = ok || pid == m.Pid
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,260 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reservoirSize is the number of example lines kept per rule.
+const reservoirSize = 5
+
+// statsInterval is the time between saves of the statistics file.
+const statsInterval = time.Minute
+
+// RuleStats contains the match statistics of a rule. Statistics are kept
+// per rule file and regex, so they survive reloads and changes to other
+// rules of the file.
+type RuleStats struct {
+	// File is the rule file relative to the rules directory.
+	File  string
+	Md5   string
+	ID    string
+	Regex string
+
+	// Added is when the rule was first loaded, zero if unknown.
+	Added time.Time
+	Count int64
+	First time.Time `json:",omitempty"`
+	Last  time.Time `json:",omitempty"`
+	// Examples is a random sample of the matched lines.
+	Examples []string `json:",omitempty"`
+}
+
+// TagStats counts the messages of a tag which were checked against rules,
+// and how many of them matched a rule.
+type TagStats struct {
+	Tag      string
+	Messages int64
+	Matched  int64
+}
+
+// Coverage returns the percentage of messages matched by a rule.
+func (s TagStats) Coverage() float64 {
+	if s.Messages == 0 {
+		return 0
+	}
+	return float64(s.Matched) * 100 / float64(s.Messages)
+}
+
+// statsFile is the format of Options.StatsFile.
+type statsFile struct {
+	Rules []RuleStats
+	Tags  []TagStats
+}
+
+type statsKey struct {
+	file, md5 string
+}
+
+// ruleStats holds the statistics of a rule while it is being updated.
+type ruleStats struct {
+	mu sync.Mutex
+	s  RuleStats
+}
+
+// record counts a match of line.
+func (rs *ruleStats) record(line string, now time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.s.Count++
+	if rs.s.First.IsZero() {
+		rs.s.First = now
+	}
+	rs.s.Last = now
+
+	// Every line has the same chance to end up in the sample.
+	if len(rs.s.Examples) < reservoirSize {
+		rs.s.Examples = append(rs.s.Examples, line)
+	} else if n := rand.Int63n(rs.s.Count); n < reservoirSize {
+		rs.s.Examples[n] = line
+	}
+}
+
+func (rs *ruleStats) get() RuleStats {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	s := rs.s
+	s.Examples = append([]string(nil), rs.s.Examples...)
+	return s
+}
+
+// attachStats links the rules of a newly loaded rule file to their
+// statistics, creating them for new rules.
+func (p *Parser) attachStats(name string, tp *tagParser) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	if p.stats == nil {
+		p.stats = make(map[statsKey]*ruleStats)
+	}
+	for _, e := range tp.entryarr {
+		k := statsKey{name, e.Md5}
+		rs, x := p.stats[k]
+		if !x {
+			rs = &ruleStats{s: RuleStats{File: name, Md5: e.Md5, Added: time.Now()}}
+			p.stats[k] = rs
+		}
+		rs.mu.Lock()
+		rs.s.ID = e.ID
+		rs.s.Regex = e.raw
+		rs.mu.Unlock()
+		e.stats = rs
+	}
+}
+
+// Stats returns the statistics of all loaded rules, ordered like Rules.
+func (p *Parser) Stats() []RuleStats {
+	var stats []RuleStats
+	for _, e := range p.Rules() {
+		if e.stats != nil {
+			stats = append(stats, e.stats.get())
+		}
+	}
+	return stats
+}
+
+// tagCounter holds the statistics of a tag while it is being updated.
+type tagCounter struct {
+	messages, matched int64 // accessed atomically
+}
+
+// countTag counts a checked message of a tag.
+func (p *Parser) countTag(tag string, matched bool) {
+	v, x := p.tags.Load(tag)
+	if !x {
+		v, _ = p.tags.LoadOrStore(tag, new(tagCounter))
+	}
+	tc := v.(*tagCounter)
+	atomic.AddInt64(&tc.messages, 1)
+	if matched {
+		atomic.AddInt64(&tc.matched, 1)
+	}
+}
+
+// TagStats returns the statistics of all tags for which messages were
+// checked, ordered by tag. Tags are normalised.
+func (p *Parser) TagStats() []TagStats {
+	var stats []TagStats
+	p.tags.Range(func(k, v interface{}) bool {
+		tc := v.(*tagCounter)
+		stats = append(stats, TagStats{
+			Tag:      k.(string),
+			Messages: atomic.LoadInt64(&tc.messages),
+			Matched:  atomic.LoadInt64(&tc.matched),
+		})
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Tag < stats[j].Tag })
+	return stats
+}
+
+// ReadStats reads a statistics file written by a Parser, see
+// Options.StatsFile. Older files only contain a list of rule statistics,
+// without tags and without the time rules were added.
+func ReadStats(fn string) ([]RuleStats, []TagStats, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sf statsFile
+	if err := json.Unmarshal(b, &sf); err != nil {
+		var rules []RuleStats
+		if json.Unmarshal(b, &rules) != nil {
+			return nil, nil, err
+		}
+		return rules, nil, nil
+	}
+	return sf.Rules, sf.Tags, nil
+}
+
+// loadStats reads the statistics file configured in Options.StatsFile.
+// A missing file is not an error. Rules without an added time are taken
+// as added now.
+func (p *Parser) loadStats() error {
+	rules, tags, err := ReadStats(p.opts.StatsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	p.stats = make(map[statsKey]*ruleStats)
+	now := time.Now()
+	for _, s := range rules {
+		if s.Added.IsZero() {
+			s.Added = now
+		}
+		p.stats[statsKey{s.File, s.Md5}] = &ruleStats{s: s}
+	}
+	for _, s := range tags {
+		p.tags.Store(s.Tag, &tagCounter{messages: s.Messages, matched: s.Matched})
+	}
+	return nil
+}
+
+// SaveStats writes the statistics of all loaded rules and tags to the file
+// configured in Options.StatsFile. Statistics of rules which no longer
+// exist are dropped. It is called periodically, call it before exiting
+// to save the latest statistics.
+func (p *Parser) SaveStats() error {
+	if p.opts.StatsFile == "" {
+		return nil
+	}
+	b, err := json.Marshal(statsFile{Rules: p.Stats(), Tags: p.TagStats()})
+	if err != nil {
+		return err
+	}
+
+	// Write a new file and rename it, so a crash never leaves a partial file.
+	dir, base := filepath.Split(p.opts.StatsFile)
+	f, err := ioutil.TempFile(dir, "."+base)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p.opts.StatsFile)
+}
+
+func (p *Parser) statsSaver() {
+	t := time.NewTicker(statsInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-p.quit:
+			return
+		}
+		if err := p.SaveStats(); err != nil {
+			fmt.Printf("Saving rule statistics to %s failed: %v\n", p.opts.StatsFile, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// reloadDelay is the time between noticing a change and reloading.
+const reloadDelay = 500 * time.Millisecond
+
+// pollInterval is the time between checks when the rules directory can't
+// be watched.
+const pollInterval = 10 * time.Second
+
+// notify sends a non blocking change notification.
+func notify(changed chan<- bool) {
+	select {
+	case changed <- true:
+	default:
+	}
+}
+
+// poll checks the rules directory for added, removed and modified files.
+// Last is the snapshot to compare the first check with.
+// It returns when the Parser is closed.
+func (p *Parser) poll(changed chan<- bool, last string) {
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-p.quit:
+			return
+		}
+		cur := p.snapshot()
+		if cur != last {
+			last = cur
+			notify(changed)
+		}
+	}
+}
+
+// snapshot returns a string describing the names, sizes and modification
+// times of all rule files.
+func (p *Parser) snapshot() string {
+	files, err := ruleFiles(os.DirFS(p.path), ".")
+	if err != nil {
+		return err.Error()
+	}
+	s := ""
+	for _, fn := range files {
+		fi, err := os.Stat(p.path + "/" + fn)
+		if err != nil {
+			s += fn + " " + err.Error() + "\n"
+			continue
+		}
+		s += fmt.Sprintf("%s %d %d\n", fn, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return s
+}
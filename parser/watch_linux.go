@@ -0,0 +1,73 @@
+package parser
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MODIFY | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_ATTRIB | syscall.IN_DELETE_SELF
+
+// watch uses inotify to notify about changes in the rules directory and
+// its subdirectories. The inotify descriptor is non blocking so reads go
+// through the runtime poller and are interrupted when Close closes it.
+func (p *Parser) watch(changed chan<- bool) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	if err := addWatches(fd, p.path); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	p.goRun(func() {
+		<-p.quit
+		f.Close()
+	})
+	p.goRun(func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := f.Read(buf)
+			select {
+			case <-p.quit:
+				return
+			default:
+			}
+			if err != nil || n <= 0 {
+				fmt.Printf("Watching %s stopped, polling for changes: %v\n", p.path, err)
+				p.poll(changed, p.snapshot())
+				return
+			}
+			// Watch subdirectories created since the last event.
+			addWatches(fd, p.path)
+			notify(changed)
+		}
+	})
+	return nil
+}
+
+// addWatches watches dir and all its subdirectories. Adding a watch for a
+// directory which is already watched is harmless.
+func addWatches(fd int, dir string) error {
+	if _, err := syscall.InotifyAddWatch(fd, dir, watchMask); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+			if err := addWatches(fd, dir+"/"+f.Name()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package parser
+
+import "errors"
+
+// watch is only supported on Linux, other systems poll for changes.
+func (p *Parser) watch(changed chan<- bool) error {
+	return errors.New("watching is not supported on this system")
+}
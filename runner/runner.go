@@ -0,0 +1,304 @@
+// Package runner runs configured commands for matched rules.
+//
+// Rules can't run arbitrary commands, they name one of the commands of the
+// configuration. Commands are run without a shell, with a clean
+// environment, limited in how many run at once, how often they run and
+// how long they may run. On Linux a command runs in its own process group,
+// which is killed as a whole on timeout or when gosyslogd dies, optionally
+// as another user, and with limits on its CPU time, memory and open files.
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Errors returned by Run.
+var (
+	ErrUnknown     = errors.New("unknown command")
+	ErrRateLimited = errors.New("rate limit exceeded")
+	ErrQueueFull   = errors.New("too many commands waiting")
+)
+
+// DefaultPath is the PATH of commands.
+const DefaultPath = "/usr/local/bin:/usr/bin:/bin"
+
+// Command is a command which can be run.
+type Command struct {
+	Name string
+	// Args contains the program and its arguments.
+	Args []string
+	// Dir is the working directory, default "/".
+	Dir string
+	// User, if set, is the user the command runs as. Only supported on
+	// Linux, and gosyslogd must run as root.
+	User string
+	// Timeout kills the command when it runs longer, default 10 seconds.
+	Timeout time.Duration
+	// Rate limits the number of runs per minute, 0 for no limit.
+	Rate int
+	// MaxOutput is the number of bytes of output kept, default 4096.
+	MaxOutput int
+	// MaxMemory limits the address space in bytes, default 1 GiB, and
+	// MaxFiles the number of open files, default 256. The CPU time is
+	// limited to Timeout. Only supported on Linux.
+	MaxMemory int64
+	MaxFiles  int
+}
+
+// Options contain the configuration of a Runner.
+type Options struct {
+	Commands []Command
+	// Concurrency is the number of commands running at once, default 4.
+	Concurrency int
+	// Queue is the number of runs waiting for a free slot, default 100.
+	Queue int
+	// OnResult, if set, is called with the result of every run.
+	OnResult func(r Result)
+}
+
+// Result is the outcome of a run.
+type Result struct {
+	Command  string
+	Start    time.Time
+	Duration time.Duration
+	// ExitCode is -1 if the command could not be started or was killed.
+	ExitCode int
+	TimedOut bool `json:",omitempty"`
+	// Output contains the start of stdout and stderr.
+	Output string
+	Error  string `json:",omitempty"`
+}
+
+// Stats counts the runs of a command.
+type Stats struct {
+	Command string
+	Runs    int64
+	// Failed counts runs which did not exit with 0, including TimedOut.
+	Failed   int64
+	TimedOut int64
+	// Dropped counts runs which were not started because of the rate
+	// limit or a full queue.
+	Dropped int64
+	Last    *Result `json:",omitempty"`
+}
+
+type job struct {
+	cmd   *command
+	env   []string
+	stdin []byte
+}
+
+// command is a Command with its state.
+type command struct {
+	Command
+	stats  Stats
+	tokens float64
+	refill time.Time
+}
+
+// Runner runs commands. It is safe for concurrent use.
+type Runner struct {
+	opts     Options
+	commands map[string]*command
+	queue    chan job
+	mu       sync.Mutex
+}
+
+// New checks the commands and starts the runner.
+func New(opts Options) (*Runner, error) {
+	if opts.Concurrency == 0 {
+		opts.Concurrency = 4
+	}
+	if opts.Queue == 0 {
+		opts.Queue = 100
+	}
+	r := &Runner{
+		opts:     opts,
+		commands: make(map[string]*command),
+		queue:    make(chan job, opts.Queue),
+	}
+	for _, c := range opts.Commands {
+		if c.Name == "" || len(c.Args) == 0 {
+			return nil, fmt.Errorf("command %q needs a name and arguments", c.Name)
+		}
+		if _, x := r.commands[c.Name]; x {
+			return nil, fmt.Errorf("duplicate command %s", c.Name)
+		}
+		if _, err := exec.LookPath(c.Args[0]); err != nil {
+			return nil, fmt.Errorf("command %s: %v", c.Name, err)
+		}
+		if c.User != "" {
+			if _, err := credential(c.User); err != nil {
+				return nil, fmt.Errorf("command %s: %v", c.Name, err)
+			}
+		}
+		if c.Dir == "" {
+			c.Dir = "/"
+		}
+		if c.Timeout == 0 {
+			c.Timeout = 10 * time.Second
+		}
+		if c.MaxOutput == 0 {
+			c.MaxOutput = 4096
+		}
+		if c.MaxMemory == 0 {
+			c.MaxMemory = 1 << 30
+		}
+		if c.MaxFiles == 0 {
+			c.MaxFiles = 256
+		}
+		r.commands[c.Name] = &command{Command: c, stats: Stats{Command: c.Name}, tokens: float64(c.Rate)}
+	}
+	for i := 0; i < opts.Concurrency; i++ {
+		go r.worker()
+	}
+	return r, nil
+}
+
+// Run queues a run of the named command. Env is added to the environment
+// of the command, which only contains PATH otherwise, and stdin is its
+// input. Run doesn't wait for the command, the result is passed to
+// Options.OnResult and recorded in the statistics.
+func (r *Runner) Run(name string, env []string, stdin []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, x := r.commands[name]
+	if !x {
+		return ErrUnknown
+	}
+	if !c.allow(time.Now()) {
+		c.stats.Dropped++
+		return ErrRateLimited
+	}
+	select {
+	case r.queue <- job{c, env, stdin}:
+		return nil
+	default:
+		c.stats.Dropped++
+		return ErrQueueFull
+	}
+}
+
+// allow takes a token of the rate limit, the bucket holds a minute of runs.
+func (c *command) allow(now time.Time) bool {
+	if c.Rate == 0 {
+		return true
+	}
+	c.tokens += now.Sub(c.refill).Minutes() * float64(c.Rate)
+	if c.tokens > float64(c.Rate) {
+		c.tokens = float64(c.Rate)
+	}
+	c.refill = now
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+func (r *Runner) worker() {
+	for j := range r.queue {
+		res := j.cmd.run(j.env, j.stdin)
+
+		r.mu.Lock()
+		s := &j.cmd.stats
+		s.Runs++
+		if res.ExitCode != 0 {
+			s.Failed++
+		}
+		if res.TimedOut {
+			s.TimedOut++
+		}
+		s.Last = &res
+		r.mu.Unlock()
+
+		if r.opts.OnResult != nil {
+			r.opts.OnResult(res)
+		}
+	}
+}
+
+func (c *command) run(env []string, stdin []byte) Result {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	cmd.Dir = c.Dir
+	cmd.Env = append([]string{"PATH=" + DefaultPath}, env...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	out := &limitedBuffer{max: c.MaxOutput}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	// Don't wait for children which keep the output open after a kill.
+	cmd.WaitDelay = time.Second
+	sandbox(cmd, c.User)
+
+	res := Result{Command: c.Name, Start: time.Now(), ExitCode: -1}
+	err := cmd.Start()
+	if err == nil {
+		if err = limit(cmd.Process.Pid, &c.Command); err != nil {
+			cancel()
+			cmd.Wait()
+		} else {
+			err = cmd.Wait()
+		}
+	}
+	res.Duration = time.Since(res.Start)
+	res.Output = out.String()
+	if cmd.ProcessState != nil {
+		res.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		res.TimedOut = true
+		res.ExitCode = -1
+		res.Error = "timeout"
+	} else if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Stats returns the statistics of all commands, ordered by name.
+func (r *Runner) Stats() []Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make([]Stats, 0, len(r.commands))
+	for _, c := range r.commands {
+		stats = append(stats, c.stats)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Command < stats[j].Command })
+	return stats
+}
+
+// limitedBuffer keeps the first max bytes written to it and discards the
+// rest, so commands never block on their output.
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int
+	mu  sync.Mutex
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n := b.max - b.buf.Len(); n > 0 {
+		if len(p) < n {
+			n = len(p)
+		}
+		b.buf.Write(p[:n])
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,63 @@
+package runner
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunner(t *testing.T) {
+	results := make(chan Result, 10)
+	r, err := New(Options{
+		Commands: []Command{
+			{Name: "echo", Args: []string{"/bin/sh", "-c", `echo "$RULE"; cat; exit 3`}, Rate: 2},
+			{Name: "sleep", Args: []string{"/bin/sh", "-c", "sleep 10 & sleep 10"}, Timeout: 100 * time.Millisecond},
+			{Name: "flood", Args: []string{"/bin/sh", "-c", "yes | head -c 100000"}, MaxOutput: 10},
+		},
+		OnResult: func(res Result) { results <- res },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Run("echo", []string{"RULE=ssh"}, []byte("line")); err != nil {
+		t.Fatal(err)
+	}
+	res := <-results
+	if res.ExitCode != 3 || res.Output != "ssh\nline" {
+		t.Errorf("Unexpected result %+v", res)
+	}
+
+	r.Run("echo", nil, nil)
+	<-results
+	if err := r.Run("echo", nil, nil); err != ErrRateLimited {
+		t.Errorf("Expected the rate limit, got %v", err)
+	}
+	if err := r.Run("rm", nil, nil); err != ErrUnknown {
+		t.Errorf("Expected an unknown command, got %v", err)
+	}
+
+	r.Run("sleep", nil, nil)
+	res = <-results
+	if !res.TimedOut || res.Duration > 5*time.Second {
+		t.Errorf("Expected a timeout, got %+v", res)
+	}
+
+	r.Run("flood", nil, nil)
+	res = <-results
+	if res.Output != strings.Repeat("y\n", 5) {
+		t.Errorf("Expected output to be limited, got %q", res.Output)
+	}
+
+	stats := r.Stats()
+	if len(stats) != 3 || stats[0].Command != "echo" || stats[0].Runs != 2 || stats[0].Failed != 2 || stats[0].Dropped != 1 {
+		t.Errorf("Unexpected statistics %+v", stats[0])
+	}
+	if stats[2].TimedOut != 1 {
+		t.Errorf("Expected a timeout to be counted, got %+v", stats[2])
+	}
+
+	if _, err := New(Options{Commands: []Command{{Name: "x", Args: []string{"/nonexistent"}}}}); err == nil {
+		t.Error("Expected an error for a missing program")
+	}
+}
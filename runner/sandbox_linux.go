@@ -0,0 +1,79 @@
+package runner
+
+import (
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// sandbox runs cmd in its own process group, which is killed as a whole
+// when the command is cancelled, as user if set. The command is killed
+// when gosyslogd dies.
+func sandbox(cmd *exec.Cmd, user string) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+	if user != "" {
+		cmd.SysProcAttr.Credential, _ = credential(user)
+	}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// credential looks up the uid and primary gid of a user.
+func credential(name string) (*syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}, nil
+}
+
+// limit sets the resource limits of a started command: its CPU time to the
+// timeout, its address space to MaxMemory and its open files to MaxFiles.
+// Limits can't be set in the child before it runs the program, so they
+// apply from just after the start. Limits above the current ones of the
+// command are left alone.
+func limit(pid int, c *Command) error {
+	cpu := (c.Timeout + time.Second - 1) / time.Second
+	for _, l := range []struct {
+		resource int
+		max      uint64
+	}{
+		{syscall.RLIMIT_CPU, uint64(cpu)},
+		{syscall.RLIMIT_AS, uint64(c.MaxMemory)},
+		{syscall.RLIMIT_NOFILE, uint64(c.MaxFiles)},
+	} {
+		var rl syscall.Rlimit
+		if err := prlimit(pid, l.resource, nil, &rl); err != nil {
+			return err
+		}
+		if l.max >= rl.Max {
+			continue
+		}
+		rl.Cur, rl.Max = l.max, l.max
+		if err := prlimit(pid, l.resource, &rl, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prlimit(pid, resource int, limit, old *syscall.Rlimit) error {
+	_, _, e := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource),
+		uintptr(unsafe.Pointer(limit)), uintptr(unsafe.Pointer(old)), 0, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
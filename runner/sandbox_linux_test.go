@@ -0,0 +1,23 @@
+package runner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	results := make(chan Result, 1)
+	r, err := New(Options{
+		Commands: []Command{
+			{Name: "limits", Args: []string{"/bin/sh", "-c", "sleep 0.2; ulimit -n; ulimit -v; ulimit -t"}, Timeout: 2500 * time.Millisecond, MaxMemory: 64 << 20, MaxFiles: 32},
+		},
+		OnResult: func(res Result) { results <- res },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Run("limits", nil, nil)
+	if res := <-results; res.Output != "32\n65536\n3\n" {
+		t.Errorf("Unexpected limits %+v", res)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package runner
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// sandbox does nothing, process groups and users are only supported on
+// Linux.
+func sandbox(cmd *exec.Cmd, user string) {}
+
+// limit does nothing, resource limits are only supported on Linux.
+func limit(pid int, c *Command) error { return nil }
+
+func credential(name string) (interface{}, error) {
+	return nil, errors.New("running commands as another user is not supported on this system")
+}
@@ -12,20 +12,24 @@ import (
 )
 
 type archfile struct {
-	buf  *bufio.Writer
-	file *os.File
-	sync bool
-	last time.Time
-	mu   sync.Mutex
+	buf   *bufio.Writer
+	file  *os.File
+	chain *chainWriter
+	index *indexWriter
+	sync  bool
+	last  time.Time
+	mu    sync.Mutex
 }
 
 type archive struct {
 	files map[string]*archfile
 	path  string
+	opts  Options
 }
 
-func newArchive(path string) *archive {
-	a := &archive{files: map[string]*archfile{}, path: path}
+func newArchive(opts Options) *archive {
+	path := opts.LogDir
+	a := &archive{files: map[string]*archfile{}, path: path, opts: opts}
 
 	if path != "" {
 		go a.syncer()
@@ -49,18 +53,49 @@ func (a *archive) reloader(sig chan os.Signal) {
 func (af *archfile) Sync() {
 	if af.sync && af.last.Add(2*time.Second).Before(time.Now()) {
 		af.mu.Lock()
-		af.buf.Flush()
+		af.flush()
 		af.mu.Unlock()
 	}
 }
 
+// flush writes the file buffer and a hash chain checkpoint if enabled.
+func (af *archfile) flush() {
+	af.buf.Flush()
+	if af.chain != nil {
+		if err := af.chain.flush(); err != nil {
+			fmt.Printf("Can't write checkpoint for %s: %v\n", af.file.Name(), err)
+		}
+	}
+}
+
+func (af *archfile) close() {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	af.buf.Flush()
+	if af.chain != nil {
+		if err := af.chain.close(); err != nil {
+			fmt.Printf("Can't write checkpoint for %s: %v\n", af.file.Name(), err)
+		}
+	}
+	if af.index != nil {
+		af.index.close()
+	}
+	af.file.Close()
+}
+
+// closed notifies the OnClose callback about a closed archive file.
+func (a *archive) closed(fn string) {
+	if a.opts.OnClose != nil {
+		a.opts.OnClose(fn)
+	}
+}
+
 // CheckClose checks if the last received message was more than 2 minutes ago and closes itself.
 // Returns true if the file was closed, false otherwise.
 func (af *archfile) CheckClose() bool {
 	// Close if latest log is < 2 minute ago.
 	if af.last.Add(2 * time.Minute).Before(time.Now()) {
-		af.buf.Flush()
-		af.file.Close()
+		af.close()
 		return true
 	}
 	return false
@@ -68,9 +103,9 @@ func (af *archfile) CheckClose() bool {
 
 func (a *archive) CloseAll() {
 	for fn, f := range a.files {
-		f.buf.Flush()
-		f.file.Close()
+		f.close()
 		delete(a.files, fn)
+		a.closed(fn)
 	}
 }
 
@@ -81,6 +116,7 @@ func (a *archive) syncer() {
 			af.Sync()
 			if af.CheckClose() {
 				delete(a.files, fn)
+				a.closed(fn)
 			}
 		}
 	}
@@ -93,7 +129,7 @@ func (a *archive) write(m *Message) {
 	// XXX make configurable.
 	//fn := fmt.Sprintf("%s/%s.%s.log", config.C.LogDir, m.Facility(), m.Severity())
 	//fn := fmt.Sprintf("%s/%04d/%02d/%02d/%s/%s.%s.log", config.C.LogDir, time.Now().Year(), time.Now().Month(), time.Now().Day(), m.Hostname, m.Facility(), m.Severity())
-	fn := fmt.Sprintf("%s/%04d/%02d/%02d/%s.log", a.path, time.Now().Year(), time.Now().Month(), time.Now().Day(), m.Hostname)
+	fn := fmt.Sprintf("%s/%s.log", ArchiveDir(a.path, time.Now()), m.Hostname)
 
 	if _, x := a.files[fn]; !x {
 		os.MkdirAll(path.Dir(fn), 0755)
@@ -101,15 +137,51 @@ func (a *archive) write(m *Message) {
 		if err != nil {
 			panic(err)
 		}
-		a.files[fn] = &archfile{buf: bufio.NewWriter(f), file: f}
+		af := &archfile{buf: bufio.NewWriter(f), file: f}
+		if a.opts.Chain {
+			af.chain, err = newChainWriter(fn, a.opts.ChainKey, a.opts.ChainInterval)
+			if err != nil {
+				panic(err)
+			}
+		}
+		if a.opts.IndexLines > 0 || a.opts.IndexInterval > 0 {
+			fi, err := f.Stat()
+			if err != nil {
+				panic(err)
+			}
+			af.index, err = newIndexWriter(fn, fi.Size(), a.opts.IndexLines, a.opts.IndexInterval)
+			if err != nil {
+				panic(err)
+			}
+		}
+		a.files[fn] = af
 	}
 
-	a.files[fn].write(m)
+	line := m.Raw
+	if a.opts.ArchivePriority {
+		line = append([]byte(fmt.Sprintf("<%d>", m.Priority)), m.Raw...)
+	}
+	t := m.Time
+	if t.IsZero() {
+		t = m.Received
+	}
+	a.files[fn].write(line, t)
 }
 
-func (af *archfile) write(m *Message) {
+// ArchiveDir returns the directory below logdir where the archive files of
+// the day of t are stored.
+func ArchiveDir(logdir string, t time.Time) string {
+	return fmt.Sprintf("%s/%04d/%02d/%02d", logdir, t.Year(), t.Month(), t.Day())
+}
+
+func (af *archfile) write(line []byte, t time.Time) {
 	af.mu.Lock()
-	_, err := af.buf.Write(m.Raw)
+	if af.index != nil {
+		if err := af.index.write(line, t); err != nil {
+			panic(err)
+		}
+	}
+	_, err := af.buf.Write(line)
 	if err != nil {
 		panic(err)
 	}
@@ -117,6 +189,12 @@ func (af *archfile) write(m *Message) {
 	if err != nil {
 		panic(err)
 	}
+	if af.chain != nil {
+		af.chain.write(line)
+		if af.chain.due() {
+			af.flush()
+		}
+	}
 	af.mu.Unlock()
 	af.last = time.Now()
 	af.sync = true
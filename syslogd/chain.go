@@ -0,0 +1,355 @@
+package syslogd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultChainInterval = 100
+
+// ChainSuffix is appended to an archive file name to get the name of its
+// hash chain sidecar file.
+const ChainSuffix = ".chain"
+
+// chain maintains a running hash over the lines of an archive file. Each line
+// is hashed together with the hash of the previous line, so altering, removing
+// or inserting a line changes every hash after it. When a key is set the chain
+// uses HMAC-SHA256, otherwise plain SHA-256.
+type chain struct {
+	key    []byte
+	sum    []byte
+	line   int64
+	offset int64
+}
+
+func newChain(key []byte) *chain {
+	return &chain{key: key, sum: make([]byte, sha256.Size)}
+}
+
+func (c *chain) hash() hash.Hash {
+	if len(c.key) > 0 {
+		return hmac.New(sha256.New, c.key)
+	}
+	return sha256.New()
+}
+
+// add folds a single line, excluding the newline, into the chain.
+func (c *chain) add(line []byte) {
+	h := c.hash()
+	h.Write(c.sum)
+	h.Write(line)
+	c.sum = h.Sum(nil)
+	c.line++
+	c.offset += int64(len(line)) + 1
+}
+
+// checkpoint records the state of the chain after a given line. A resumed
+// checkpoint covers lines which were found in the archive file after a
+// restart, they were not seen by the writer and are not verified by it.
+type checkpoint struct {
+	line    int64
+	offset  int64
+	time    int64
+	sum     string
+	resumed bool
+}
+
+func (cp *checkpoint) payload() string {
+	s := fmt.Sprintf("%d %d %d %s", cp.line, cp.offset, cp.time, cp.sum)
+	if cp.resumed {
+		s += " resumed"
+	}
+	return s
+}
+
+// sign returns the signature of a checkpoint so a checkpoint can not be
+// rewritten without knowing the key.
+func (c *chain) sign(cp *checkpoint) string {
+	h := c.hash()
+	io.WriteString(h, cp.payload())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *chain) checkpoint() *checkpoint {
+	return &checkpoint{
+		line:   c.line,
+		offset: c.offset,
+		time:   time.Now().Unix(),
+		sum:    hex.EncodeToString(c.sum),
+	}
+}
+
+// format returns the sidecar representation of a checkpoint:
+// "line offset unixtime chainsum [resumed] signature".
+func (c *chain) format(cp *checkpoint) string {
+	return cp.payload() + " " + c.sign(cp) + "\n"
+}
+
+func parseCheckpoint(s string) (*checkpoint, string, error) {
+	f := strings.Fields(s)
+	cp := new(checkpoint)
+	if len(f) == 6 && f[4] == "resumed" {
+		cp.resumed = true
+		f = append(f[:4], f[5])
+	}
+	if len(f) != 5 {
+		return nil, "", fmt.Errorf("Invalid checkpoint %q", s)
+	}
+	var err error
+	if cp.line, err = strconv.ParseInt(f[0], 10, 64); err != nil {
+		return nil, "", err
+	}
+	if cp.offset, err = strconv.ParseInt(f[1], 10, 64); err != nil {
+		return nil, "", err
+	}
+	if cp.time, err = strconv.ParseInt(f[2], 10, 64); err != nil {
+		return nil, "", err
+	}
+	cp.sum = f[3]
+	return cp, f[4], nil
+}
+
+func readCheckpoints(fn string) ([]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if s.Text() != "" {
+			lines = append(lines, s.Text())
+		}
+	}
+	return lines, s.Err()
+}
+
+// chainWriter keeps the hash chain of an open archive file and appends
+// checkpoints to its sidecar file.
+type chainWriter struct {
+	*chain
+	side     *os.File
+	interval int
+	pending  int
+}
+
+// newChainWriter opens the sidecar of archive file fn and resumes the chain
+// from its last checkpoint. Lines written after it, e.g. before a crash, are
+// folded in with a resumed checkpoint, so they are reported as unverified
+// instead of being vouched for by the next checkpoint.
+func newChainWriter(fn string, key []byte, interval int) (*chainWriter, error) {
+	if interval <= 0 {
+		interval = defaultChainInterval
+	}
+	cw := &chainWriter{chain: newChain(key), interval: interval}
+
+	cps, err := readCheckpoints(fn + ChainSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(cps) > 0 {
+		cp, sig, err := parseCheckpoint(cps[len(cps)-1])
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal([]byte(sig), []byte(cw.sign(cp))) {
+			return nil, fmt.Errorf("Last checkpoint of %s has an invalid signature", fn)
+		}
+		cw.sum, err = hex.DecodeString(cp.sum)
+		if err != nil {
+			return nil, err
+		}
+		cw.line = cp.line
+		cw.offset = cp.offset
+	}
+
+	f, err := os.Open(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer f.Close()
+		if _, err := f.Seek(cw.offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		r := bufio.NewReader(f)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 && line[len(line)-1] == '\n' {
+				cw.add(line[:len(line)-1])
+				cw.pending++
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	cw.side, err = os.OpenFile(fn+ChainSuffix, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0664)
+	if err != nil {
+		return nil, err
+	}
+	if cw.pending > 0 {
+		fmt.Printf("Archive %s has %d lines after its last checkpoint, they are marked unverified.\n", fn, cw.pending)
+		cp := cw.checkpoint()
+		cp.resumed = true
+		if _, err := io.WriteString(cw.side, cw.format(cp)); err != nil {
+			cw.side.Close()
+			return nil, err
+		}
+		cw.pending = 0
+	}
+	return cw, nil
+}
+
+// write folds a record into the chain. Records containing newlines are
+// hashed per line, the same way VerifyArchive reads them back.
+func (cw *chainWriter) write(rec []byte) {
+	for _, line := range bytes.Split(rec, []byte("\n")) {
+		cw.add(line)
+		cw.pending++
+	}
+}
+
+// due returns true if enough lines were written to warrant a new checkpoint.
+func (cw *chainWriter) due() bool {
+	return cw.pending >= cw.interval
+}
+
+// flush writes a checkpoint if any lines were added since the last one.
+// The archive file must be flushed to disk before calling flush.
+func (cw *chainWriter) flush() error {
+	if cw.pending == 0 {
+		return nil
+	}
+	_, err := io.WriteString(cw.side, cw.format(cw.checkpoint()))
+	cw.pending = 0
+	return err
+}
+
+func (cw *chainWriter) close() error {
+	err := cw.flush()
+	cw.side.Close()
+	return err
+}
+
+// Verification contains the result of verifying an archive file.
+type Verification struct {
+	// Lines is the number of lines in the archive file.
+	Lines int64
+	// Checkpoints is the number of checkpoints found in the sidecar file.
+	Checkpoints int
+	// Verified is the number of lines covered by valid checkpoints.
+	Verified int64
+	// Unverified contains the first and last line of ranges which were
+	// found in the archive file after a restart. They are part of the
+	// chain, so later changes are detected, but nothing vouches for their
+	// original content.
+	Unverified [][2]int64
+	// Trailing is the number of lines after the last checkpoint.
+	Trailing int64
+	// Tampered is true if the archive or its sidecar was altered.
+	Tampered bool
+	// FirstBad and LastBad are the range of lines which contains the first
+	// altered line. When checkpoints are written for every line both are equal.
+	FirstBad, LastBad int64
+	// Reason describes why verification failed.
+	Reason string
+}
+
+// ErrNoChain is returned by VerifyArchive if an archive file has no sidecar.
+var ErrNoChain = errors.New("No hash chain found")
+
+// VerifyArchive recomputes the hash chain of archive file fn and compares it
+// against all checkpoints in its sidecar file. Key must be the same key which
+// was used when writing the archive.
+func VerifyArchive(fn string, key []byte) (*Verification, error) {
+	cps, err := readCheckpoints(fn + ChainSuffix)
+	if os.IsNotExist(err) {
+		return nil, ErrNoChain
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	v := &Verification{Checkpoints: len(cps)}
+	c := newChain(key)
+	r := bufio.NewReader(f)
+	var prev int64
+	eof := false
+
+	fail := func(reason string, last int64) {
+		v.Tampered = true
+		v.FirstBad = prev + 1
+		v.LastBad = last
+		v.Reason = reason
+	}
+
+	for i, s := range cps {
+		cp, sig, err := parseCheckpoint(s)
+		if err != nil {
+			fail(fmt.Sprintf("checkpoint %d: %v", i+1, err), prev+1)
+			break
+		}
+		if !hmac.Equal([]byte(sig), []byte(c.sign(cp))) {
+			fail(fmt.Sprintf("checkpoint %d has an invalid signature", i+1), cp.line)
+			break
+		}
+		for c.line < cp.line && !eof {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 && line[len(line)-1] == '\n' {
+				c.add(line[:len(line)-1])
+			} else if len(line) > 0 {
+				c.add(line)
+			}
+			eof = err != nil
+		}
+		if c.line < cp.line {
+			fail(fmt.Sprintf("file ends at line %d before checkpoint %d", c.line, i+1), cp.line)
+			break
+		}
+		if hex.EncodeToString(c.sum) != cp.sum || c.offset != cp.offset {
+			fail(fmt.Sprintf("chain does not match checkpoint %d", i+1), cp.line)
+			break
+		}
+		if cp.resumed {
+			v.Unverified = append(v.Unverified, [2]int64{prev + 1, cp.line})
+		} else {
+			v.Verified += cp.line - prev
+		}
+		prev = cp.line
+	}
+
+	// Count the remaining lines, those are not covered by any checkpoint.
+	v.Lines = c.line
+	for !eof {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			v.Lines++
+		}
+		eof = err != nil
+	}
+	if !v.Tampered {
+		v.Trailing = v.Lines - prev
+	}
+	return v, nil
+}
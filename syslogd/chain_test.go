@@ -0,0 +1,81 @@
+package syslogd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeChained(t *testing.T, fn string, key []byte, lines []string) {
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cw, err := newChainWriter(fn, key, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range lines {
+		f.WriteString(l + "\n")
+		cw.write([]byte(l))
+		if cw.due() {
+			cw.flush()
+		}
+	}
+	cw.close()
+}
+
+func TestChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := []byte("secret")
+	fn := filepath.Join(dir, "host001.log")
+	writeChained(t, fn, key, []string{"one", "two", "three"})
+	// Reopening resumes the chain from the last checkpoint.
+	writeChained(t, fn, key, []string{"four", "five"})
+
+	v, err := VerifyArchive(fn, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Tampered || v.Lines != 5 || v.Verified != 5 {
+		t.Fatalf("Expected 5 verified lines, got %+v", v)
+	}
+
+	v, _ = VerifyArchive(fn, []byte("wrong"))
+	if !v.Tampered {
+		t.Error("Expected verification with the wrong key to fail")
+	}
+
+	// Lines written without a checkpoint, like before a crash, are not
+	// vouched for by the checkpoints written after reopening.
+	f, _ := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0664)
+	f.WriteString("six\nseven\n")
+	f.Close()
+	writeChained(t, fn, key, []string{"eight"})
+	v, err = VerifyArchive(fn, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Tampered || v.Lines != 8 || v.Verified != 6 || len(v.Unverified) != 1 || v.Unverified[0] != [2]int64{6, 7} || v.Trailing != 0 {
+		t.Fatalf("Expected lines 6-7 to be unverified, got %+v", v)
+	}
+
+	b, _ := ioutil.ReadFile(fn)
+	ioutil.WriteFile(fn, bytes.Replace(b, []byte("four"), []byte("f0ur"), 1), 0664)
+	v, err = VerifyArchive(fn, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Tampered || v.FirstBad != 4 || v.LastBad != 5 {
+		t.Errorf("Expected tampering between lines 4 and 5, got %+v", v)
+	}
+}
@@ -0,0 +1,120 @@
+package syslogd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IndexSuffix is appended to an archive file name to get the name of its
+// time index sidecar file.
+const IndexSuffix = ".idx"
+
+// indexSkew is how far message times may be out of order in an archive file
+// and still be found by a Seek. Messages are archived in the order they are
+// received, senders with a clock that is off by more than this may be missed.
+const indexSkew = 10 * time.Minute
+
+// indexEntry maps a message time to the byte offset of its line.
+type indexEntry struct {
+	time   int64
+	offset int64
+}
+
+// indexWriter appends a sparse time index for an archive file to its
+// sidecar file. An entry is written every lines lines or every interval,
+// whichever comes first. Entries are kept in ascending time order, lines
+// with a time earlier than the last entry are not indexed.
+type indexWriter struct {
+	file     *os.File
+	offset   int64
+	lines    int
+	interval time.Duration
+	count    int
+	last     time.Time
+}
+
+func newIndexWriter(fn string, offset int64, lines int, interval time.Duration) (*indexWriter, error) {
+	f, err := os.OpenFile(fn+IndexSuffix, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0664)
+	if err != nil {
+		return nil, err
+	}
+	iw := &indexWriter{file: f, offset: offset, lines: lines, interval: interval}
+
+	// Continue after the last entry of a reopened file.
+	if entries, err := readIndex(fn); err == nil && len(entries) > 0 {
+		iw.last = time.Unix(entries[len(entries)-1].time, 0)
+	}
+	return iw, nil
+}
+
+// write is called for every line written to the archive file, before the
+// line is written.
+func (iw *indexWriter) write(line []byte, t time.Time) error {
+	defer func() {
+		iw.offset += int64(len(line)) + 1
+		iw.count++
+	}()
+
+	if t.Before(iw.last) {
+		return nil
+	}
+	due := iw.last.IsZero() ||
+		(iw.lines > 0 && iw.count >= iw.lines) ||
+		(iw.interval > 0 && t.Sub(iw.last) >= iw.interval)
+	if !due {
+		return nil
+	}
+
+	iw.count = 0
+	iw.last = t
+	_, err := fmt.Fprintf(iw.file, "%d %d\n", t.Unix(), iw.offset)
+	return err
+}
+
+func (iw *indexWriter) close() error {
+	return iw.file.Close()
+}
+
+// readIndex reads the index sidecar of archive file fn.
+func readIndex(fn string) ([]indexEntry, error) {
+	f, err := os.Open(fn + IndexSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []indexEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fs := strings.Fields(s.Text())
+		if len(fs) != 2 {
+			continue
+		}
+		t, err1 := strconv.ParseInt(fs[0], 10, 64)
+		o, err2 := strconv.ParseInt(fs[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		entries = append(entries, indexEntry{time: t, offset: o})
+	}
+	return entries, s.Err()
+}
+
+// indexStart returns the offset in an archive file from which to read the
+// messages at or after from, based on its index entries. Lines before an
+// entry may be up to indexSkew later than the entry, so it starts at the
+// last entry before from minus indexSkew.
+func indexStart(entries []indexEntry, from time.Time) int64 {
+	n := sort.Search(len(entries), func(i int) bool {
+		return entries[i].time >= from.Add(-indexSkew).Unix()
+	})
+	if n > 0 {
+		return entries[n-1].offset
+	}
+	return 0
+}
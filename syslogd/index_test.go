@@ -0,0 +1,190 @@
+package syslogd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIndexSeek(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "host001.log")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iw, err := newIndexWriter(fn, 0, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2016, 3, 12, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+	for i := 0; i < 100; i++ {
+		ts := t0.Add(time.Duration(i) * time.Minute)
+		line := []byte(fmt.Sprintf("%s host001 tag: line %d", ts.Format(time.RFC3339), i))
+		iw.write(line, ts)
+		f.Write(append(line, '\n'))
+	}
+	iw.close()
+	f.Close()
+
+	ar, err := OpenArchive(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+	if err := ar.Seek(t0.Add(35 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	var first, last *Message
+	n := 0
+	for {
+		m, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = m
+		}
+		last = m
+		n++
+	}
+
+	// Entries are written every 10 lines, the start is widened to those
+	// and by the out of order margin.
+	if !first.Time.Equal(t0.Add(20 * time.Minute)) {
+		t.Errorf("Expected to start at 00:20, got %v", first.Time)
+	}
+	if !last.Time.Equal(t0.Add(99 * time.Minute)) {
+		t.Errorf("Expected to read until the end, got %v", last.Time)
+	}
+	if n != 80 {
+		t.Errorf("Expected to read 80 lines, got %d", n)
+	}
+}
+
+func TestIndexOutOfOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "host001.log")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iw, err := newIndexWriter(fn, 0, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every third line comes from a sender with a clock 5 minutes behind,
+	// those lines are not indexed.
+	t0 := time.Date(2016, 3, 12, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+	for i := 0; i < 100; i++ {
+		ts := t0.Add(time.Duration(i) * time.Minute)
+		if i%3 == 0 {
+			ts = ts.Add(-5 * time.Minute)
+		}
+		line := []byte(fmt.Sprintf("%s host001 tag: line %d", ts.Format(time.RFC3339), i))
+		iw.write(line, ts)
+		f.Write(append(line, '\n'))
+	}
+	iw.close()
+	f.Close()
+
+	from, to := t0.Add(40*time.Minute), t0.Add(50*time.Minute)
+	ar, err := OpenArchive(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+	if err := ar.Seek(from); err != nil {
+		t.Fatal(err)
+	}
+
+	var found []string
+	for {
+		m, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !m.Time.Before(from) && !m.Time.After(to) {
+			found = append(found, string(m.Content()))
+		}
+	}
+
+	// Lines 40 to 50 and the late lines 45, 48, 51, 54.
+	want := []string{
+		"line 40", "line 41", "line 43", "line 44", "line 45", "line 46", "line 47",
+		"line 48", "line 49", "line 50", "line 51", "line 54",
+	}
+	if fmt.Sprint(found) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, found)
+	}
+}
+
+func TestSeekFutureLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A sender with a clock a day ahead must not end the range.
+	fn := filepath.Join(dir, "host001.log")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2016, 3, 12, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+	for i := 0; i < 10; i++ {
+		ts := t0.Add(time.Duration(i) * time.Minute)
+		if i == 3 {
+			ts = ts.AddDate(0, 0, 1)
+		}
+		fmt.Fprintf(f, "%s host001 tag: line %d\n", ts.Format(time.RFC3339), i)
+	}
+	f.Close()
+
+	ar, err := OpenArchive(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+	if err := ar.Seek(t0); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for {
+		_, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 10 {
+		t.Errorf("Expected to read all 10 lines, got %d", n)
+	}
+}
@@ -2,6 +2,7 @@ package syslogd
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log/syslog"
 	"os"
@@ -16,19 +17,29 @@ import (
 // Not all fields might be available in each message.
 type Message struct {
 	Received time.Time
+	Time     time.Time
 	Priority syslog.Priority
 	Hostname string
 	Tag      string
 	Pid      int
 	Raw      []byte
+
+	// Fields contains values extracted from the message by a parser.
+	Fields map[string]string `json:",omitempty"`
 }
 
+// NoPriority is used as Priority for messages read from files which do not
+// contain the syslog priority.
+const NoPriority syslog.Priority = -1
+
 var sysfmt *regexp.Regexp
+var linefmt *regexp.Regexp
 var mu sync.Mutex
 var hostname string
 
 func init() {
 	sysfmt = regexp.MustCompile("<([0-9]+)>(.{15}|.{25}) (.*?): (.*)")
+	linefmt = regexp.MustCompile("^(?:<([0-9]+)>)?(.{15}|.{25}) (.*?): (.*)")
 
 	h, err := os.Hostname()
 	if err != nil {
@@ -51,10 +62,72 @@ func NewMessage(pkt []byte, size int) (*Message, error) {
 
 	p, _ := strconv.ParseInt(string(res[1]), 10, 64)
 	msg.Priority = syslog.Priority(p)
-	// received timestamp = res[2]
+	msg.Time = parseTime(string(res[2]), msg.Received)
+	msg.splitTag(res[3])
+
+	// Raw string excluding priority including timestamp.
+	n := bytes.IndexByte(pkt, '>')
+	if n > 0 {
+		if size > 0 {
+			msg.Raw = bytes.TrimSpace(pkt[n+1 : size])
+		} else {
+			msg.Raw = bytes.TrimSpace(pkt[n+1:])
+		}
+	} else {
+		msg.Raw = bytes.TrimSpace(pkt)
+	}
+
+	return msg, nil
+}
+
+// ParseLine parses a line as written to a syslog file, like the archive files
+// of a Server. The syslog priority is optional, if missing Priority is set
+// to NoPriority. Timestamps without a year are taken relative to ref, which is
+// also used as the received time.
+func ParseLine(line []byte, ref time.Time) (*Message, error) {
+	line = bytes.TrimSpace(line)
+	res := linefmt.FindSubmatch(line)
+	if len(res) != 5 {
+		return nil, fmt.Errorf("Cant parse: %s", string(line))
+	}
+
+	msg := new(Message)
+	msg.Received = ref
+	msg.Priority = NoPriority
+	if len(res[1]) > 0 {
+		p, _ := strconv.ParseInt(string(res[1]), 10, 64)
+		msg.Priority = syslog.Priority(p)
+		line = line[bytes.IndexByte(line, '>')+1:]
+	}
+	msg.Time = parseTime(string(res[2]), ref)
+	msg.splitTag(res[3])
+	msg.Raw = line
+	return msg, nil
+}
+
+// parseTime parses either an RFC3339 or a traditional syslog timestamp.
+// Traditional timestamps have no year, the year closest to ref is used.
+// Returns a zero time if the timestamp can't be parsed.
+func parseTime(s string, ref time.Time) time.Time {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t
+	}
+	t, err := time.ParseInLocation(time.Stamp, s, ref.Location())
+	if err != nil {
+		return time.Time{}
+	}
+	t = t.AddDate(ref.Year(), 0, 0)
+	// Messages from the end of last year received after new year.
+	if t.Sub(ref) > 24*time.Hour {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
 
+// splitTag sets Hostname, Tag and Pid from the part of a message
+// between the timestamp and the colon.
+func (msg *Message) splitTag(misc []byte) {
 	tagpid := ""
-	misc := res[3]
 	// Check for either "hostname tagpid" or "tagpid"
 	a := bytes.SplitN(misc, []byte(" "), 2)
 	if len(a) == 2 {
@@ -67,49 +140,97 @@ func NewMessage(pkt []byte, size int) (*Message, error) {
 
 	// tagpid is either "tag[pid]" or just "tag".
 	if n := strings.Index(tagpid, "["); n > 0 {
-		p, _ = strconv.ParseInt(tagpid[n+1:(len(tagpid)-1)], 10, 64)
+		p, _ := strconv.ParseInt(tagpid[n+1:(len(tagpid)-1)], 10, 64)
 		msg.Pid = int(p)
 		msg.Tag = tagpid[:n]
 	} else {
 		msg.Tag = tagpid
 	}
-
-	// Raw string excluding priority including timestamp.
-	n := bytes.IndexByte(pkt, '>')
-	if n > 0 {
-		if size > 0 {
-			msg.Raw = bytes.TrimSpace(pkt[n+1 : size])
-		} else {
-			msg.Raw = bytes.TrimSpace(pkt[n+1:])
-		}
-	} else {
-		msg.Raw = bytes.TrimSpace(pkt)
-	}
-
-	return msg, nil
 }
 
-var severeties = [...]string{
+// Severities are the syslog severity names, indexed by severity.
+var Severities = [...]string{
 	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
 }
 
-var facilities = [...]string{
+// Facilities are the syslog facility names, indexed by facility.
+var Facilities = [...]string{
 	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
 	"uucp", "cron", "authpriv", "ftp", "unknown", "unknown", "unknown", "unknown",
 	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
 }
 
+// ParseSeverity returns the severity for a name like "err", or -1 if unknown.
+func ParseSeverity(s string) int {
+	for i, v := range Severities {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// ParseFacility returns the facility for a name like "auth", or -1 if unknown.
+func ParseFacility(s string) int {
+	if s == "unknown" {
+		return -1
+	}
+	for i, v := range Facilities {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
 // Severity returns the curent severity string from a Message (e.g. "notice")
 func (m *Message) Severity() string {
-	return severeties[m.Priority&7]
+	if m.Priority == NoPriority {
+		return "unknown"
+	}
+	return Severities[m.Priority&7]
 }
 
 // Facility returns the curent facility string from a Message (e.g. "local1")
 func (m *Message) Facility() string {
-	return facilities[m.Priority>>3]
+	if m.Priority == NoPriority {
+		return "unknown"
+	}
+	return Facilities[m.Priority>>3]
+}
+
+// Content returns the text of a message, the part of Raw after the tag.
+func (m *Message) Content() []byte {
+	if n := bytes.Index(m.Raw, []byte(": ")); n >= 0 {
+		return m.Raw[n+2:]
+	}
+	return m.Raw
 }
 
 // PriorityString returns the curent severity and facility string from a Message (e.g. "local1.notice")
 func (m *Message) PriorityString() string {
 	return m.Facility() + "." + m.Severity()
 }
+
+// MarshalJSON encodes a Message with Raw as a string instead of base64.
+func (m Message) MarshalJSON() ([]byte, error) {
+	type message Message
+	return json.Marshal(struct {
+		message
+		Raw string
+	}{message(m), string(m.Raw)})
+}
+
+// UnmarshalJSON decodes a Message encoded by MarshalJSON.
+func (m *Message) UnmarshalJSON(b []byte) error {
+	type message Message
+	v := struct {
+		*message
+		Raw string
+	}{message: (*message)(m)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	m.Raw = []byte(v.Raw)
+	return nil
+}
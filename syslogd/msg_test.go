@@ -1,7 +1,10 @@
 package syslogd
 
 import (
+	"encoding/json"
+	"log/syslog"
 	"testing"
+	"time"
 )
 
 func TestMessage(t *testing.T) {
@@ -83,3 +86,112 @@ func TestMaybeParsable(t *testing.T) {
 		t.Log("Did not expect a valid message.")
 	}
 }
+
+func TestParseLine(t *testing.T) {
+	ref := time.Date(2016, 3, 12, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		line     string
+		pri      syslog.Priority
+		host     string
+		tag      string
+		pid      int
+		raw      string
+		priority string
+	}{
+		{"<27>2016-03-12T11:10:49+01:00 host001 sshd[12]: payload", 27, "host001", "sshd", 12, "2016-03-12T11:10:49+01:00 host001 sshd[12]: payload", "daemon.err"},
+		{"Mar 12 11:10:49 host001 cron: payload", NoPriority, "host001", "cron", 0, "Mar 12 11:10:49 host001 cron: payload", "unknown.unknown"},
+		{"<86>Mar 12 11:10:49 host001 sudo[7]: a: b  ", 86, "host001", "sudo", 7, "Mar 12 11:10:49 host001 sudo[7]: a: b", "authpriv.info"},
+		{"  <0>Mar 12 11:10:49 kernel: x", 0, hostname, "kernel", 0, "Mar 12 11:10:49 kernel: x", "kern.emerg"},
+	}
+	for _, tt := range tests {
+		m, err := ParseLine([]byte(tt.line), ref)
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if m.Priority != tt.pri || m.Hostname != tt.host || m.Tag != tt.tag || m.Pid != tt.pid || string(m.Raw) != tt.raw {
+			t.Errorf("%q: got %d %q %q %d %q", tt.line, m.Priority, m.Hostname, m.Tag, m.Pid, m.Raw)
+		}
+		if m.PriorityString() != tt.priority {
+			t.Errorf("%q: expected priority %s, got %s", tt.line, tt.priority, m.PriorityString())
+		}
+		if !m.Received.Equal(ref) || m.Time.IsZero() {
+			t.Errorf("%q: unexpected times %v %v", tt.line, m.Received, m.Time)
+		}
+	}
+
+	for _, line := range []string{"", "no timestamp here", "Mar 12 11:10:49 host001 no colon"} {
+		if _, err := ParseLine([]byte(line), ref); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	ref := time.Date(2016, 1, 1, 0, 5, 0, 0, time.UTC)
+	tests := []struct {
+		s    string
+		want time.Time
+	}{
+		{"2016-03-12T11:10:49+01:00", time.Date(2016, 3, 12, 10, 10, 49, 0, time.UTC)},
+		{"Jan  1 00:04:00", time.Date(2016, 1, 1, 0, 4, 0, 0, time.UTC)},
+		{"Jan  1 23:00:00", time.Date(2016, 1, 1, 23, 0, 0, 0, time.UTC)},
+		// Sent last year, received after new year.
+		{"Dec 31 23:59:59", time.Date(2015, 12, 31, 23, 59, 59, 0, time.UTC)},
+		{"Mar 32 11:10:49", time.Time{}},
+		{"garbage", time.Time{}},
+	}
+	for _, tt := range tests {
+		if got := parseTime(tt.s, ref); !got.Equal(tt.want) {
+			t.Errorf("parseTime(%q) = %v, expected %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestPriorityNames(t *testing.T) {
+	tests := []struct {
+		s             string
+		sev, facility int
+	}{
+		{"emerg", 0, -1},
+		{"debug", 7, -1},
+		{"kern", -1, 0},
+		{"authpriv", -1, 10},
+		{"local7", -1, 23},
+		{"unknown", -1, -1},
+		{"foo", -1, -1},
+		{"", -1, -1},
+	}
+	for _, tt := range tests {
+		if got := ParseSeverity(tt.s); got != tt.sev {
+			t.Errorf("ParseSeverity(%q) = %d, expected %d", tt.s, got, tt.sev)
+		}
+		if got := ParseFacility(tt.s); got != tt.facility {
+			t.Errorf("ParseFacility(%q) = %d, expected %d", tt.s, got, tt.facility)
+		}
+	}
+}
+
+func TestMessageJSON(t *testing.T) {
+	m := &Message{Time: time.Date(2016, 3, 12, 11, 10, 49, 0, time.UTC), Hostname: "host001", Tag: "sshd", Raw: []byte("host001 sshd: payload")}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]interface{}
+	json.Unmarshal(b, &v)
+	if v["Raw"] != "host001 sshd: payload" || v["Hostname"] != "host001" {
+		t.Errorf("Expected Raw as a string, got %s", b)
+	}
+	if _, x := v["Fields"]; x {
+		t.Errorf("Expected empty Fields to be left out, got %s", b)
+	}
+
+	var m2 Message
+	if err := json.Unmarshal(b, &m2); err != nil {
+		t.Fatal(err)
+	}
+	if string(m2.Raw) != string(m.Raw) || m2.Tag != "sshd" || !m2.Time.Equal(m.Time) {
+		t.Errorf("Expected %+v, got %+v", m, m2)
+	}
+}
@@ -0,0 +1,151 @@
+package syslogd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArchiveReader reads messages from plain or gzip compressed syslog files,
+// such as the archive files written by a Server.
+type ArchiveReader struct {
+	// Name is the file name of the archive.
+	Name string
+	// Skipped counts the lines which could not be parsed.
+	Skipped int
+
+	file *os.File
+	gz   *gzip.Reader
+	r    *bufio.Reader
+	ref  time.Time
+}
+
+// OpenArchive opens an archive file for reading. Files ending in ".gz" are
+// decompressed on the fly.
+func OpenArchive(fn string) (*ArchiveReader, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	ar := &ArchiveReader{Name: fn, file: f}
+	if strings.HasSuffix(fn, ".gz") {
+		ar.gz, err = gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		ar.r = bufio.NewReader(ar.gz)
+	} else {
+		ar.r = bufio.NewReader(f)
+	}
+
+	// Use the end of the day as reference for timestamps without a year.
+	ar.ref = ArchiveDate(fn)
+	if !ar.ref.IsZero() {
+		ar.ref = ar.ref.AddDate(0, 0, 1).Add(-time.Second)
+	} else {
+		fi, err := f.Stat()
+		if err != nil {
+			ar.Close()
+			return nil, err
+		}
+		ar.ref = fi.ModTime()
+	}
+	return ar, nil
+}
+
+// ArchiveDate returns the day of an archive file based on its YYYY/MM/DD
+// directory, or a zero time if the file is not in such a directory.
+func ArchiveDate(fn string) time.Time {
+	d := strings.Split(filepath.ToSlash(filepath.Dir(fn)), "/")
+	if len(d) < 3 {
+		return time.Time{}
+	}
+	var n [3]int
+	for i, s := range d[len(d)-3:] {
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return time.Time{}
+		}
+		n[i] = v
+	}
+	return time.Date(n[0], time.Month(n[1]), n[2], 0, 0, 0, 0, time.Local)
+}
+
+// Next returns the next message. Lines which can't be parsed are skipped.
+// Returns io.EOF at the end of the file.
+func (ar *ArchiveReader) Next() (*Message, error) {
+	for {
+		line, err := ar.r.ReadBytes('\n')
+		if len(line) > 0 {
+			m, perr := ParseLine(line, ar.ref)
+			if perr == nil {
+				return m, nil
+			}
+			ar.Skipped++
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Seek positions the reader near the first message at or after from using
+// the index sidecar of the archive file. The index is sparse and messages
+// may be out of order, so callers still have to filter on the message time,
+// and have to read until the end of the file as a single line with a wrong
+// clock must not end the range. Compressed files and files without an index
+// are read from the start.
+func (ar *ArchiveReader) Seek(from time.Time) error {
+	if ar.gz != nil {
+		return nil
+	}
+	entries, err := readIndex(ar.Name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := ar.file.Seek(indexStart(entries, from), io.SeekStart); err != nil {
+		return err
+	}
+	ar.r = bufio.NewReader(ar.file)
+	return nil
+}
+
+// Close closes the archive file.
+func (ar *ArchiveReader) Close() error {
+	if ar.gz != nil {
+		ar.gz.Close()
+	}
+	return ar.file.Close()
+}
+
+// ArchiveFiles returns the plain and compressed archive files stored below
+// logdir for the day of t.
+func ArchiveFiles(logdir string, t time.Time) ([]string, error) {
+	dir := ArchiveDir(logdir, t)
+	files, err := filepath.Glob(dir + "/*.log")
+	if err != nil {
+		return nil, err
+	}
+	gz, err := filepath.Glob(dir + "/*.log.gz")
+	if err != nil {
+		return nil, err
+	}
+	return append(files, gz...), nil
+}
+
+// ArchiveHost returns the host name of an archive file.
+func ArchiveHost(fn string) string {
+	fn = strings.TrimSuffix(filepath.Base(fn), ".gz")
+	return strings.TrimSuffix(fn, ".log")
+}
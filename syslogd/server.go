@@ -42,6 +42,38 @@ type Options struct {
 
 	// LogDir defines the path where to store logfiles. Leave empty to not write logfiles.
 	LogDir string
+
+	// ArchivePriority keeps the "<PRI>" header of each message in the archive
+	// files, so the priority of archived messages can be searched on.
+	ArchivePriority bool
+
+	// Chain enables a tamper evident hash chain over each archive file. Signed
+	// checkpoints are written to a sidecar file named after the archive file
+	// with ChainSuffix appended. Use VerifyArchive to check an archive file.
+	Chain bool
+
+	// ChainKey is the secret used to sign the hash chain. If empty, the chain
+	// uses unkeyed SHA-256 which only detects naive modifications.
+	ChainKey []byte
+
+	// ChainInterval is the number of lines between checkpoints, default 100.
+	// Checkpoints are also written whenever a file is flushed or closed.
+	// Tampering is located with the precision of the interval.
+	ChainInterval int
+
+	// IndexLines and IndexInterval enable a sparse time index for each
+	// archive file, which maps message times to byte offsets. An entry is
+	// written every IndexLines lines or every IndexInterval, whichever comes
+	// first. The index is stored in a sidecar file named after the archive
+	// file with IndexSuffix appended and used by ArchiveReader.Seek.
+	IndexLines    int
+	IndexInterval time.Duration
+
+	// OnClose, if set, is called with the file name of each archive file after
+	// it has been closed, for example to ship it elsewhere. Files are closed
+	// when idle for 2 minutes, when reopened on SIGHUP and on Close. A file can
+	// be reopened later the same day when new messages arrive.
+	OnClose func(fn string)
 }
 
 // Server contains internal data for syslog server processes.
@@ -210,7 +242,7 @@ func NewServer(opts Options) *Server {
 
 	s.bus = make(chan *Message, opts.BufferSize)
 	s.stop = make(chan bool)
-	s.arch = newArchive(opts.LogDir)
+	s.arch = newArchive(opts)
 
 	err := s.listenUnix()
 	if err != nil {
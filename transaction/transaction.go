@@ -0,0 +1,259 @@
+// Package transaction assembles messages which belong together, like all
+// lines of a postfix queue id, into transactions.
+//
+// Rules with a "transaction" setting name the capture group containing the
+// transaction id. All matches from the same host with the same capture
+// group name and id form a transaction. A transaction ends when a rule with
+// "end = true" matches, or after it was idle for the timeout. Rules with an
+// "outcome" setting set its outcome, transactions ending by timeout without
+// an outcome get the outcome "timeout".
+package transaction
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// OutcomeTimeout is the outcome of transactions which ended by timeout
+// without an outcome.
+const OutcomeTimeout = "timeout"
+
+// Options contain the configuration of a Tracker.
+type Options struct {
+	// Timeout ends transactions without messages for this long,
+	// default 10 minutes.
+	Timeout time.Duration
+	// MaxMessages limits the number of messages kept per transaction,
+	// default 100. Further messages are counted but not kept.
+	MaxMessages int
+	// Keep is the number of ended transactions kept for queries,
+	// default 10000.
+	Keep int
+	// OnEnd, if set, is called with every ended transaction.
+	OnEnd func(t *Transaction)
+}
+
+// Transaction is a group of messages sharing a transaction id.
+type Transaction struct {
+	// Field is the name of the capture group of the id.
+	Field    string
+	ID       string
+	Hostname string
+	Start    time.Time
+	End      time.Time
+	Outcome  string `json:",omitempty"`
+	Ended    bool
+	// Md5 is the sum of the rule which matched the last message.
+	Md5 string
+	// Fields contains all fields extracted from the messages, later
+	// messages override earlier ones.
+	Fields   map[string]string
+	Count    int
+	Messages []*syslogd.Message
+}
+
+// Query selects transactions, empty fields match everything.
+type Query struct {
+	Field    string
+	ID       string
+	Hostname string
+	Outcome  string
+	// Fields must all be equal to the fields of a transaction.
+	Fields map[string]string
+	// Open selects only transactions which did not end yet.
+	Open bool
+	// Limit is the maximum number of results, 0 for no limit.
+	Limit int
+}
+
+// Tracker collects transactions. It is safe for concurrent use.
+type Tracker struct {
+	opts  Options
+	open  map[string]*Transaction
+	ended []*Transaction
+	next  int
+	mu    sync.Mutex
+
+	// quit is closed by Close to stop ending idle transactions.
+	quit      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// New creates a Tracker and starts ending idle transactions until Close.
+func New(opts Options) *Tracker {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Minute
+	}
+	if opts.MaxMessages == 0 {
+		opts.MaxMessages = 100
+	}
+	if opts.Keep == 0 {
+		opts.Keep = 10000
+	}
+	t := &Tracker{opts: opts, open: make(map[string]*Transaction), quit: make(chan struct{})}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.expirer()
+	}()
+	return t
+}
+
+// Close stops ending idle transactions and waits for an expiry in
+// progress to finish. Open transactions are kept.
+func (t *Tracker) Close() {
+	t.closeOnce.Do(func() { close(t.quit) })
+	t.wg.Wait()
+}
+
+func key(host, field, id string) string {
+	return host + "\x00" + field + "\x00" + id
+}
+
+// Add adds a message matched by rule e to its transaction. Messages of
+// rules without transaction, or without a transaction id, are ignored.
+// Now is the time of the message.
+func (t *Tracker) Add(e *parser.Logent, m *syslogd.Message, now time.Time) {
+	tr := e.Transaction
+	if tr == nil || m.Fields[tr.Field] == "" {
+		return
+	}
+	id := m.Fields[tr.Field]
+	k := key(m.Hostname, tr.Field, id)
+
+	t.mu.Lock()
+	tx, x := t.open[k]
+	if !x {
+		tx = &Transaction{Field: tr.Field, ID: id, Hostname: m.Hostname, Start: now, Fields: make(map[string]string)}
+		t.open[k] = tx
+	}
+	tx.End = now
+	tx.Md5 = e.Md5
+	tx.Count++
+	if len(tx.Messages) < t.opts.MaxMessages {
+		tx.Messages = append(tx.Messages, m)
+	}
+	for f, v := range m.Fields {
+		tx.Fields[f] = v
+	}
+	if tr.Outcome != "" {
+		if f := strings.TrimPrefix(tr.Outcome, "field:"); f != tr.Outcome {
+			tx.Outcome = m.Fields[f]
+		} else {
+			tx.Outcome = tr.Outcome
+		}
+	}
+	if !tr.End {
+		t.mu.Unlock()
+		return
+	}
+	t.end(k, tx)
+	t.mu.Unlock()
+	t.notify(tx)
+}
+
+// end moves a transaction to the ended transactions, t.mu must be held.
+func (t *Tracker) end(k string, tx *Transaction) {
+	delete(t.open, k)
+	tx.Ended = true
+	if len(t.ended) < t.opts.Keep {
+		t.ended = append(t.ended, tx)
+	} else {
+		t.ended[t.next] = tx
+		t.next = (t.next + 1) % t.opts.Keep
+	}
+}
+
+// notify calls OnEnd, t.mu must not be held.
+func (t *Tracker) notify(tx *Transaction) {
+	if t.opts.OnEnd != nil {
+		t.opts.OnEnd(tx)
+	}
+}
+
+func (t *Tracker) expirer() {
+	tick := time.NewTicker(t.opts.Timeout / 10)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			t.Expire(now)
+		case <-t.quit:
+			return
+		}
+	}
+}
+
+// Expire ends transactions which were idle for the timeout at now. It is
+// called periodically.
+func (t *Tracker) Expire(now time.Time) {
+	var done []*Transaction
+	t.mu.Lock()
+	for k, tx := range t.open {
+		if now.Sub(tx.End) >= t.opts.Timeout {
+			if tx.Outcome == "" {
+				tx.Outcome = OutcomeTimeout
+			}
+			t.end(k, tx)
+			done = append(done, tx)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, tx := range done {
+		t.notify(tx)
+	}
+}
+
+// Find returns copies of the transactions selected by q, most recently
+// active first.
+func (t *Tracker) Find(q Query) []Transaction {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var res []Transaction
+	add := func(tx *Transaction) {
+		if q.matches(tx) {
+			c := *tx
+			c.Fields = make(map[string]string, len(tx.Fields))
+			for f, v := range tx.Fields {
+				c.Fields[f] = v
+			}
+			c.Messages = append([]*syslogd.Message(nil), tx.Messages...)
+			res = append(res, c)
+		}
+	}
+	for _, tx := range t.open {
+		add(tx)
+	}
+	if !q.Open {
+		for _, tx := range t.ended {
+			add(tx)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].End.After(res[j].End) })
+	if q.Limit > 0 && len(res) > q.Limit {
+		res = res[:q.Limit]
+	}
+	return res
+}
+
+func (q Query) matches(tx *Transaction) bool {
+	if (q.Field != "" && q.Field != tx.Field) || (q.ID != "" && q.ID != tx.ID) ||
+		(q.Hostname != "" && q.Hostname != tx.Hostname) || (q.Outcome != "" && q.Outcome != tx.Outcome) {
+		return false
+	}
+	for f, v := range q.Fields {
+		if tx.Fields[f] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+package transaction
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tomarus/gosyslogd/parser"
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+func TestTransactions(t *testing.T) {
+	ended := make(chan *Transaction, 10)
+	tr := New(Options{Timeout: time.Hour, OnEnd: func(tx *Transaction) { ended <- tx }})
+	defer tr.Close()
+
+	from := &parser.Logent{Transaction: &parser.Transaction{Field: "qid"}}
+	to := &parser.Logent{Transaction: &parser.Transaction{Field: "qid", Outcome: "field:status"}}
+	removed := &parser.Logent{Transaction: &parser.Transaction{Field: "qid", End: true}}
+
+	t0 := time.Date(2016, 3, 12, 10, 0, 0, 0, time.UTC)
+	addFrom := func(host string, e *parser.Logent, sec int, fields map[string]string) {
+		tr.Add(e, &syslogd.Message{Hostname: host, Fields: fields}, t0.Add(time.Duration(sec)*time.Second))
+	}
+	add := func(e *parser.Logent, sec int, fields map[string]string) {
+		addFrom("mx1", e, sec, fields)
+	}
+
+	add(from, 0, map[string]string{"qid": "A1", "from": "alice@example.com"})
+	add(from, 1, map[string]string{"qid": "B2", "from": "bob@example.com"})
+	// The same queue id on another host is another transaction.
+	addFrom("mx2", from, 1, map[string]string{"qid": "A1", "from": "carol@example.com"})
+	add(to, 2, map[string]string{"qid": "A1", "status": "sent"})
+	add(removed, 3, map[string]string{"qid": "A1"})
+	add(from, 4, map[string]string{"from": "no queue id"})
+
+	tx := <-ended
+	if tx.ID != "A1" || tx.Hostname != "mx1" || tx.Outcome != "sent" || tx.Count != 3 || tx.End.Sub(tx.Start) != 3*time.Second {
+		t.Errorf("Unexpected transaction %+v", tx)
+	}
+	if tx.Fields["from"] != "alice@example.com" {
+		t.Errorf("Expected the sender on mx1, got %v", tx.Fields)
+	}
+	res := tr.Find(Query{ID: "A1", Hostname: "mx2"})
+	if len(res) != 1 || res[0].Ended || res[0].Count != 1 || res[0].Fields["from"] != "carol@example.com" {
+		t.Fatalf("Expected the open transaction A1 on mx2, got %+v", res)
+	}
+
+	res = tr.Find(Query{Fields: map[string]string{"from": "bob@example.com"}})
+	if len(res) != 1 || res[0].ID != "B2" || res[0].Ended {
+		t.Fatalf("Expected the open transaction B2, got %+v", res)
+	}
+	if len(tr.Find(Query{Open: true})) != 2 || len(tr.Find(Query{Outcome: "sent"})) != 1 {
+		t.Error("Unexpected query results")
+	}
+
+	tr.Expire(t0.Add(2 * time.Hour))
+	for i := 0; i < 2; i++ {
+		tx = <-ended
+		if (tx.ID != "B2" && tx.Hostname != "mx2") || tx.Outcome != OutcomeTimeout {
+			t.Errorf("Expected B2 and A1 on mx2 to time out, got %+v", tx)
+		}
+	}
+}
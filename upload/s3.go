@@ -0,0 +1,164 @@
+package upload
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bucket is a minimal client for S3 compatible object storage using path
+// style requests signed with AWS signature version 4.
+type bucket struct {
+	endpoint  *url.URL
+	region    string
+	name      string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newBucket(opts Options) (*bucket, error) {
+	u, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid endpoint %q", opts.Endpoint)
+	}
+	b := &bucket{
+		endpoint:  u,
+		region:    opts.Region,
+		name:      opts.Bucket,
+		accessKey: opts.AccessKey,
+		secretKey: opts.SecretKey,
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}
+	if b.region == "" {
+		b.region = "us-east-1"
+	}
+	return b, nil
+}
+
+func (b *bucket) url(key string) string {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.name + "/" + key
+	return u.String()
+}
+
+// head returns the ETag of an object without quotes, or an empty string
+// if the object does not exist.
+func (b *bucket) head(key string) (string, error) {
+	req, err := http.NewRequest("HEAD", b.url(key), nil)
+	if err != nil {
+		return "", err
+	}
+	b.sign(req, emptySHA256, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+	case http.StatusNotFound:
+		return "", nil
+	}
+	return "", fmt.Errorf("HEAD %s: %s", key, resp.Status)
+}
+
+// put uploads body and returns the ETag of the new object without quotes.
+// The server verifies the upload against the Content-MD5 header.
+func (b *bucket) put(key string, body io.ReadSeeker, size int64, md5b64, sha256hex string) (string, error) {
+	req, err := http.NewRequest("PUT", b.url(key), body)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-MD5", md5b64)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	b.sign(req, sha256hex, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("PUT %s: %s %s", key, resp.Status, msg)
+	}
+	return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
+
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	io.WriteString(h, s)
+	return h.Sum(nil)
+}
+
+// sign adds an AWS signature version 4 Authorization header to req.
+// Requests are sent unsigned if no access key is configured.
+func (b *bucket) sign(req *http.Request, payload string, t time.Time) {
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if b.accessKey == "" {
+		return
+	}
+
+	t = t.UTC()
+	amzdate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzdate)
+
+	hdrs := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "content-md5" || lk == "content-type" || strings.HasPrefix(lk, "x-amz-") {
+			hdrs[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(hdrs))
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canon strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canon, "%s:%s\n", k, hdrs[k])
+	}
+	signed := strings.Join(names, ";")
+
+	creq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canon.String(),
+		signed,
+		payload,
+	}, "\n")
+	sum := sha256.Sum256([]byte(creq))
+
+	scope := day + "/" + b.region + "/s3/aws4_request"
+	sts := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+b.secretKey), day)
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, sts))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, signed, sig))
+}
@@ -0,0 +1,345 @@
+// Package upload ships closed archive files to S3 compatible object storage.
+//
+// Only files of past days are uploaded, files of the current day may still be
+// reopened by the archive. Files are picked up when the archive closes them
+// and by a periodic sweep of the archive directory.
+//
+// Example
+//
+//	up, err := upload.New(upload.Options{Endpoint: "http://localhost:9000", Bucket: "logs", LogDir: "/var/log/gosyslogd"})
+//	sys := syslogd.NewServer(syslogd.Options{LogDir: "/var/log/gosyslogd", OnClose: up.Closed})
+package upload
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// Files modified less than settleTime ago are left alone by the sweeper,
+// they might still be open.
+const settleTime = 10 * time.Minute
+
+// sidecars lists the suffixes of files which belong to an archive file and
+// are uploaded and removed along with it.
+var sidecars = []string{syslogd.ChainSuffix, syslogd.IndexSuffix}
+
+// Options contain the configuration of an Uploader.
+type Options struct {
+	// Endpoint is the base URL of the object storage, e.g. "https://s3.amazonaws.com".
+	Endpoint string
+	// Region used for signing requests, default "us-east-1".
+	Region string
+	// Bucket to store the archive files in.
+	Bucket string
+	// Prefix is prepended to the object keys, which are the path of the
+	// archive files relative to LogDir.
+	Prefix string
+	// AccessKey and SecretKey are the credentials. Leave empty to send
+	// unsigned requests.
+	AccessKey string
+	SecretKey string
+	// Compress gzips files before uploading, ".gz" is appended to the key.
+	Compress bool
+	// Delete removes the local files after a verified upload.
+	Delete bool
+	// LogDir is the archive directory.
+	LogDir string
+	// SweepInterval is the time between scans of LogDir, default 1 hour.
+	SweepInterval time.Duration
+}
+
+// Uploader uploads archive files to object storage.
+type Uploader struct {
+	opts   Options
+	bucket *bucket
+	queue  chan string
+	done   map[string]bool
+	busy   map[string]bool
+	mu     sync.Mutex
+}
+
+// New creates an Uploader and starts uploading in the background.
+func New(opts Options) (*Uploader, error) {
+	u, err := newUploader(opts)
+	if err != nil {
+		return nil, err
+	}
+	go u.worker()
+	go u.sweeper()
+	return u, nil
+}
+
+func newUploader(opts Options) (*Uploader, error) {
+	if opts.Bucket == "" {
+		return nil, errors.New("No bucket configured.")
+	}
+	if opts.SweepInterval == 0 {
+		opts.SweepInterval = time.Hour
+	}
+	b, err := newBucket(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &Uploader{
+		opts:   opts,
+		bucket: b,
+		queue:  make(chan string, 1024),
+		done:   make(map[string]bool),
+		busy:   make(map[string]bool),
+	}
+	return u, nil
+}
+
+// Closed queues an archive file closed by the archive for uploading.
+// It is meant to be used as syslogd.Options.OnClose.
+func (u *Uploader) Closed(fn string) {
+	select {
+	case u.queue <- fn:
+	default:
+		// The sweeper will pick it up later.
+	}
+}
+
+func (u *Uploader) worker() {
+	for fn := range u.queue {
+		if !u.eligible(fn, false) {
+			continue
+		}
+		if err := u.Upload(fn); err != nil {
+			fmt.Printf("Upload of %s failed: %v\n", fn, err)
+		}
+	}
+}
+
+func (u *Uploader) sweeper() {
+	for {
+		if err := u.Sweep(); err != nil {
+			fmt.Printf("Upload sweep failed: %v\n", err)
+		}
+		time.Sleep(u.opts.SweepInterval)
+	}
+}
+
+// Sweep uploads all archive files of past days which have not been
+// modified for a while.
+func (u *Uploader) Sweep() error {
+	u.prune()
+	return filepath.Walk(u.opts.LogDir, func(fn string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// Sidecar file removed by the upload of its archive file.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !strings.HasSuffix(fn, ".log") || !u.eligible(fn, true) {
+			return nil
+		}
+		if err := u.Upload(fn); err != nil {
+			fmt.Printf("Upload of %s failed: %v\n", fn, err)
+		}
+		return nil
+	})
+}
+
+// eligible returns true if fn is an archive file of a past day which has not
+// been uploaded yet. If settle is true, recently modified files are skipped.
+func (u *Uploader) eligible(fn string, settle bool) bool {
+	day := syslogd.ArchiveDate(fn)
+	if day.IsZero() {
+		return false
+	}
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if !day.Before(today) {
+		return false
+	}
+
+	u.mu.Lock()
+	done := u.done[fn]
+	u.mu.Unlock()
+	if done {
+		return false
+	}
+
+	if settle {
+		for _, f := range append([]string{fn}, sidecarFiles(fn)...) {
+			fi, err := os.Stat(f)
+			if err == nil && now.Sub(fi.ModTime()) < settleTime {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// prune forgets uploaded files which no longer exist, so the done list
+// doesn't grow with every day of the archive.
+func (u *Uploader) prune() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for fn := range u.done {
+		if _, err := os.Stat(fn); os.IsNotExist(err) {
+			delete(u.done, fn)
+		}
+	}
+}
+
+// claim marks fn as in progress. Returns false if it is already being
+// uploaded or has been uploaded.
+func (u *Uploader) claim(fn string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.busy[fn] || u.done[fn] {
+		return false
+	}
+	u.busy[fn] = true
+	return true
+}
+
+func sidecarFiles(fn string) []string {
+	var files []string
+	for _, s := range sidecars {
+		if _, err := os.Stat(fn + s); err == nil {
+			files = append(files, fn+s)
+		}
+	}
+	return files
+}
+
+// Upload uploads an archive file and its sidecar files and verifies their
+// checksums. If configured, the local files are removed afterwards.
+// Files which are being uploaded or have been uploaded already are skipped.
+func (u *Uploader) Upload(fn string) error {
+	if !u.claim(fn) {
+		return nil
+	}
+	defer func() {
+		u.mu.Lock()
+		delete(u.busy, fn)
+		u.mu.Unlock()
+	}()
+
+	files := append([]string{fn}, sidecarFiles(fn)...)
+	for _, f := range files {
+		if err := u.uploadFile(f); err != nil {
+			return err
+		}
+	}
+
+	u.mu.Lock()
+	u.done[fn] = true
+	u.mu.Unlock()
+
+	if u.opts.Delete {
+		for _, f := range files {
+			if err := os.Remove(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// key returns the object key of a local file.
+func (u *Uploader) key(fn string) (string, error) {
+	rel, err := filepath.Rel(u.opts.LogDir, fn)
+	if err != nil {
+		return "", err
+	}
+	key := u.opts.Prefix + filepath.ToSlash(rel)
+	if u.opts.Compress {
+		key += ".gz"
+	}
+	return key, nil
+}
+
+func (u *Uploader) uploadFile(fn string) error {
+	key, err := u.key(fn)
+	if err != nil {
+		return err
+	}
+
+	f, err := u.open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h5 := md5.New()
+	h256 := sha256.New()
+	size, err := io.Copy(io.MultiWriter(h5, h256), f)
+	if err != nil {
+		return err
+	}
+	sum := h5.Sum(nil)
+	md5hex := hex.EncodeToString(sum)
+
+	// Skip files which were uploaded before, e.g. before a restart.
+	etag, err := u.bucket.head(key)
+	if err != nil {
+		return err
+	}
+	if etag == md5hex {
+		return nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	etag, err = u.bucket.put(key, f, size, base64.StdEncoding.EncodeToString(sum), hex.EncodeToString(h256.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	if etag != md5hex {
+		return fmt.Errorf("Checksum mismatch for %s, expected %s got %s", key, md5hex, etag)
+	}
+	return nil
+}
+
+// open returns the file to upload, which is a compressed temporary copy
+// if compression is enabled. The temporary file is unlinked right away so
+// it disappears on Close.
+func (u *Uploader) open(fn string) (*os.File, error) {
+	f, err := os.Open(fn)
+	if err != nil || !u.opts.Compress {
+		return f, err
+	}
+	defer f.Close()
+
+	tmp, err := ioutil.TempFile("", "gosyslogd-upload")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmp.Name())
+
+	gz := gzip.NewWriter(tmp)
+	if _, err := io.Copy(gz, f); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
@@ -0,0 +1,150 @@
+package upload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tomarus/gosyslogd/syslogd"
+)
+
+// fakeS3 is a local stand-in for S3 compatible object storage which
+// supports HEAD and PUT with Content-MD5 verification.
+type fakeS3 struct {
+	objects map[string][]byte
+	puts    int
+	mu      sync.Mutex
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case "HEAD":
+		b, x := s.objects[r.URL.Path]
+		if !x {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sum := md5.Sum(b)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case "PUT":
+		b, _ := ioutil.ReadAll(r.Body)
+		sum := md5.Sum(b)
+		if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			http.Error(w, "BadDigest", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			http.Error(w, "AccessDenied", http.StatusForbidden)
+			return
+		}
+		s.objects[r.URL.Path] = b
+		s.puts++
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	s3 := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yesterday := syslogd.ArchiveDir(dir, time.Now().AddDate(0, 0, -1))
+	today := syslogd.ArchiveDir(dir, time.Now())
+	os.MkdirAll(yesterday, 0755)
+	os.MkdirAll(today, 0755)
+
+	content := []byte("Mar 12 11:10:49 host001 sshd[1]: payload\n")
+	old := time.Now().Add(-time.Hour)
+	for _, fn := range []string{yesterday + "/host001.log", yesterday + "/host001.log" + syslogd.ChainSuffix, today + "/host001.log"} {
+		ioutil.WriteFile(fn, content, 0664)
+		os.Chtimes(fn, old, old)
+	}
+
+	u, err := newUploader(Options{Endpoint: srv.URL, Bucket: "logs", Prefix: "syslog/", AccessKey: "key", SecretKey: "secret", Compress: true, Delete: true, LogDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if s3.puts != 2 {
+		t.Errorf("Expected 2 uploads, got %d", s3.puts)
+	}
+
+	rel, _ := filepath.Rel(dir, yesterday)
+	obj, x := s3.objects["/logs/syslog/"+filepath.ToSlash(rel)+"/host001.log.gz"]
+	if !x {
+		t.Fatalf("Expected yesterday's file to be uploaded, got %d objects", len(s3.objects))
+	}
+	if _, x := s3.objects["/logs/syslog/"+filepath.ToSlash(rel)+"/host001.log"+syslogd.ChainSuffix+".gz"]; !x {
+		t.Error("Expected the sidecar file to be uploaded")
+	}
+	if len(s3.objects) != 2 {
+		t.Errorf("Expected only yesterday's files to be uploaded, got %d objects", len(s3.objects))
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(obj))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(gz)
+	if !bytes.Equal(b, content) {
+		t.Errorf("Uploaded content differs: %q", b)
+	}
+
+	if _, err := os.Stat(yesterday + "/host001.log"); !os.IsNotExist(err) {
+		t.Error("Expected local file to be removed after upload")
+	}
+	if _, err := os.Stat(today + "/host001.log"); err != nil {
+		t.Error("Expected today's file to be left alone")
+	}
+
+	// Uploaded files are skipped until they are gone.
+	if u.claim(yesterday + "/host001.log") {
+		t.Error("Expected an uploaded file not to be claimed again")
+	}
+	u.prune()
+	if len(u.done) != 0 {
+		t.Errorf("Expected removed files to be pruned, got %v", u.done)
+	}
+
+	// Files in progress are skipped.
+	if !u.claim(yesterday+"/host002.log") || u.claim(yesterday+"/host002.log") {
+		t.Error("Expected a file to be claimed once")
+	}
+	if err := u.Upload(yesterday + "/host002.log"); err != nil || s3.puts != 2 {
+		t.Errorf("Expected a claimed file to be skipped, got %v and %d uploads", err, s3.puts)
+	}
+
+	// Files which are already uploaded are not sent again.
+	ioutil.WriteFile(yesterday+"/host001.log", content, 0664)
+	if err := u.Upload(yesterday + "/host001.log"); err != nil {
+		t.Fatal(err)
+	}
+	if s3.puts != 2 {
+		t.Error("Expected an existing object not to be uploaded again")
+	}
+}